@@ -24,9 +24,13 @@ var imapCmd = &cobra.Command{
 	Long: `This mode works by using IMAP (with IDLE) to monitor a mailbox and act on
 incoming mail.
 
-Any mail, whether or not it was parsed successfully, is deleted (the assumption
-is that other mail is spam, and doesn't need to be constantly parsed just to
-fail).
+Mail is moved out of the mailbox once processed, to --processed-mailbox, or to
+--failed-mailbox if it was rejected (e.g. spam, or not a command) or couldn't
+be parsed, so that it isn't processed again. Mail which fails for other
+reasons (e.g. the database, or rate limits) is retried from the queue, so
+counts as processed.
+With --delete-mail it is deleted instead. The UID of the last mail processed
+is kept in the database, so that only new mail is fetched after reconnecting.
 
 So use a custom receiver, or at least a custom mailbox.`,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -47,7 +51,7 @@ So use a custom receiver, or at least a custom mailbox.`,
 		}
 
 		var wg sync.WaitGroup
-		wg.Add(2)
+		wg.Add(3)
 
 		shutdownChan := make(chan struct{})
 		go func() {
@@ -59,14 +63,29 @@ So use a custom receiver, or at least a custom mailbox.`,
 			wg.Wait()
 		}()
 
+		accept := fmt.Sprintf("%s@%s", to, domain)
+		dnsResolver := newResolver()
+		queue := newQueue(dbConn, accept, shutdownChan)
+		go func() {
+			defer wg.Done()
+			queue.Run()
+		}()
+
 		httpServer := web.Server{
-			Db:           dbConn,
-			FromRe:       fromRe,
-			To:           to,
-			Domain:       domain,
-			HttpPrefix:   httpPrefix,
-			ShutdownChan: shutdownChan,
-			QrSize:       viper.GetInt("qr-size-mm"),
+			Db:            dbConn,
+			FromRe:        fromRe,
+			To:            to,
+			Domain:        domain,
+			HttpPrefix:    httpPrefix,
+			ShutdownChan:  shutdownChan,
+			QrSize:        viper.GetInt("qr-size-mm"),
+			QrLanguage:    viper.GetString("qr-language"),
+			QrPlusAddress: viper.GetBool("qr-plus-address"),
+			Queue:         queue,
+			Resolver:      dnsResolver,
+			Limits:        rateLimits,
+			QrKey:         qrKey,
+			AdminPassword: viper.GetString("admin-password"),
 		}
 		go func() {
 			defer wg.Done()
@@ -74,16 +93,20 @@ So use a custom receiver, or at least a custom mailbox.`,
 		}()
 
 		imapSession := imap.Session{
-			Db:           dbConn,
-			Dkim:         dkim,
-			Delegate:     delegate,
-			LocalDkim:    localDkim,
-			Host:         viper.GetString("imap-host"),
-			User:         viper.GetString("imap-user"),
-			Mailbox:      viper.GetString("mailbox"),
-			TokenCmd:     viper.GetStringSlice("token-cmd"),
-			IdlePoll:     viper.GetDuration("idle-poll"),
-			ShutdownChan: shutdownChan,
+			Db:               dbConn,
+			Queue:            queue,
+			Host:             viper.GetString("imap-host"),
+			User:             viper.GetString("imap-user"),
+			Mailbox:          viper.GetString("mailbox"),
+			ProcessedMailbox: viper.GetString("processed-mailbox"),
+			FailedMailbox:    viper.GetString("failed-mailbox"),
+			TokenCmd:         viper.GetStringSlice("token-cmd"),
+			IdlePoll:         viper.GetDuration("idle-poll"),
+			ShutdownChan:     shutdownChan,
+		}
+		if viper.GetBool("delete-mail") {
+			imapSession.ProcessedMailbox = ""
+			imapSession.FailedMailbox = ""
 		}
 
 		go func() {
@@ -117,6 +140,12 @@ func init() {
 		"host for IMAP to connect to")
 	imapCmd.Flags().String("imap-user", "", "username to use for IMAP")
 	imapCmd.Flags().String("mailbox", "INBOX", "mailbox to watch")
+	imapCmd.Flags().String("processed-mailbox", "Processed",
+		"mailbox to move processed mail to (created if needed)")
+	imapCmd.Flags().String("failed-mailbox", "Failed",
+		"mailbox to move rejected or unparsable mail to (created if needed)")
+	imapCmd.Flags().Bool("delete-mail", false,
+		"delete mail once processed, instead of moving it")
 	imapCmd.Flags().StringArray("token-cmd",
 		[]string{"pizauth", "show", "tooltracker"},
 		"command to fetch authentication token (e.g. pizauth), specify multiple times for each argument")
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/KoviRobi/tooltracker/db"
+)
+
+// renameCmd represents the rename command
+var renameCmd = &cobra.Command{
+	Use:   "rename <tool name or ID> <new name>",
+	Short: "Rename a tool, or merge it into another one",
+	Long: `Renames the tool in the database, keeping the old name as an alias so that
+bookmarks keep working (QR codes have the tool's ID, which doesn't change). If
+there is already a tool with the new name, the tool is merged into it: the more
+recent location is kept, the tags are combined, and the description and image
+are only used if the other tool has none.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		dbConn, err := db.Open(dbPath)
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer dbConn.Close()
+
+		err = dbConn.EnsureTooltrackerTables()
+		if err != nil {
+			log.Fatalf("Failed to ensure tooltracker tables exist: %v", err)
+		}
+
+		id := dbConn.FindTool(args[0])
+		if id == "" {
+			log.Fatalf("Failed to rename %q: %v", args[0], db.ErrNoSuchTool)
+		}
+		id, err = dbConn.RenameTool(id, args[1])
+		if err != nil {
+			log.Fatalf("Failed to rename %q: %v", args[0], err)
+		}
+		log.Printf("Renamed %q to %q (ID %s)", args[0], args[1], id)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(renameCmd)
+}
@@ -61,7 +61,7 @@ port >= 1024) can be used alongside with a tool such as netcat:
 		}
 
 		var wg sync.WaitGroup
-		wg.Add(2)
+		wg.Add(3)
 
 		shutdownChan := make(chan struct{})
 		go func() {
@@ -73,29 +73,41 @@ port >= 1024) can be used alongside with a tool such as netcat:
 			wg.Wait()
 		}()
 
+		accept := fmt.Sprintf("%s@%s", to, domain)
+		dnsResolver := newResolver()
+		queue := newQueue(dbConn, accept, shutdownChan)
+		go func() {
+			defer wg.Done()
+			queue.Run()
+		}()
+
 		httpServer := web.Server{
-			Db:           dbConn,
-			FromRe:       fromRe,
-			To:           to,
-			Domain:       domain,
-			HttpPrefix:   httpPrefix,
-			ShutdownChan: shutdownChan,
-			QrSize:       viper.GetInt("qr-size-mm"),
+			Db:            dbConn,
+			FromRe:        fromRe,
+			To:            to,
+			Domain:        domain,
+			HttpPrefix:    httpPrefix,
+			ShutdownChan:  shutdownChan,
+			QrSize:        viper.GetInt("qr-size-mm"),
+			QrLanguage:    viper.GetString("qr-language"),
+			QrPlusAddress: viper.GetBool("qr-plus-address"),
+			Queue:         queue,
+			Resolver:      dnsResolver,
+			Limits:        rateLimits,
+			QrKey:         qrKey,
+			AdminPassword: viper.GetString("admin-password"),
 		}
 		go func() {
 			defer wg.Done()
 			httpServer.Serve(fmt.Sprintf("%s:%d", listen, httpPort))
 		}()
 
-		accept := fmt.Sprintf("%s@%s", to, domain)
 		backend := smtp.Backend{
-			Db:           dbConn,
+			Queue:        queue,
 			To:           accept,
-			Dkim:         dkim,
-			Delegate:     delegate,
-			LocalDkim:    localDkim,
 			FromRe:       fromRe,
 			ShutdownChan: shutdownChan,
+			Limits:       rateLimits,
 		}
 
 		smtpListen := fmt.Sprintf("%s:%d", listen, viper.GetInt("smtp-port"))
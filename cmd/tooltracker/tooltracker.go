@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/x509"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -11,12 +13,20 @@ import (
 
 	"github.com/KoviRobi/tooltracker/db"
 	"github.com/KoviRobi/tooltracker/limits"
+	"github.com/KoviRobi/tooltracker/mail"
+	"github.com/KoviRobi/tooltracker/ratelimit"
+	"github.com/KoviRobi/tooltracker/resolver"
 )
 
 var (
-	cfgFile, listen, domain, httpPrefix, from, to, dkim, dbPath string
-	localDkim, delegate                                         bool
-	httpPort                                                    int
+	cfgFile, listen, domain, httpPrefix, from, to, dkim, dbPath, relay, authservId string
+	localDkim, delegate, confirmHandover, confirmDelegation                        bool
+	httpPort                                                                       int
+	acceptAuth                                                                     []mail.AuthMethod
+	arcSealers                                                                     []string
+	smimeRoots                                                                     *x509.CertPool
+	rateLimits                                                                     ratelimit.Limits
+	qrKey                                                                          []byte
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -53,7 +63,50 @@ checked because they are trivially forged`)
 	rootCmd.PersistentFlags().Bool("delegate", true, "e-mail delegation, when using DKIM")
 	rootCmd.PersistentFlags().Bool("local-dkim", true,
 		"e-mails from the same domain as tooltracker is running on don't get DKIM")
+	rootCmd.PersistentFlags().StringSlice("accept-auth", []string{"dkim"},
+		"ways to verify the sender's domain when using --dkim, any of dkim, spf (SMTP only) and dmarc")
+	rootCmd.PersistentFlags().String("trust-authserv-id", "",
+		"trust the Authentication-Results header (dkim/spf/dmarc) added by the MTA with this authserv-id, instead of checking DKIM (default \"\", i.e. don't)")
+	rootCmd.PersistentFlags().StringSlice("trust-arc-sealer", nil,
+		"trust the results in ARC sets (e.g. from mailing lists or forwarders) sealed by these domains, if the ARC chain is valid")
+	rootCmd.PersistentFlags().String("smime-trust-store", "",
+		"PEM file of CA certificates, accept S/MIME signed mail by certificates from these for the sender (default \"\", i.e. don't)")
+	rootCmd.PersistentFlags().StringSlice("dns-server", nil,
+		"nameservers (host or host:port) for DKIM/SPF/DMARC/ARC lookups, tried in order (default those in /etc/resolv.conf)")
+	rootCmd.PersistentFlags().Duration("dns-timeout", resolver.DefaultTimeout,
+		"how long to wait for each nameserver")
+	rootCmd.PersistentFlags().Duration("dns-negative-ttl", resolver.DefaultNegativeTtl,
+		"how long to cache names which don't exist, if the nameserver doesn't say")
 	rootCmd.PersistentFlags().String("db", db.FlagDbDefault, db.FlagDbDescription)
+	rootCmd.PersistentFlags().String("relay", "",
+		"SMTP server (host:port) to send e-mails through, e.g. handover confirmations (default \"\", i.e. don't send)")
+	rootCmd.PersistentFlags().Bool("confirm-handover", false,
+		"ask the recipient of a \"Gave <tool> to <person>\" to confirm by e-mail, needs --relay")
+	rootCmd.PersistentFlags().Bool("confirm-delegation", false,
+		"ask the e-mails in an \"Alias <e-mail>\" to confirm by e-mail before they can act for the sender, needs --relay")
+
+	rootCmd.PersistentFlags().Int("workers", 2, "number of workers processing received e-mails")
+	rootCmd.PersistentFlags().Int("max-attempts", 5,
+		"attempts at processing an e-mail (e.g. on database errors) before giving up on it")
+	rootCmd.PersistentFlags().Duration("retry-backoff", 30*time.Second,
+		"delay before retrying a failed e-mail, doubled for each further retry (up to a day)")
+
+	rootCmd.PersistentFlags().Float64("rate-limit-ip", 600,
+		"SMTP connections per hour from a client IP, 0 for no limit (mail providers send everyone's mail from a few IPs)")
+	rootCmd.PersistentFlags().Float64("rate-limit-sender", 60, "e-mails per hour from a sender, 0 for no limit")
+	rootCmd.PersistentFlags().Float64("rate-limit-tool", 30, "changes per hour to a tool, 0 for no limit")
+	rootCmd.PersistentFlags().Int("rate-limit-burst", 20, "how many can come at once, before the rate limits apply")
+	rootCmd.PersistentFlags().Int("max-new-tools-per-day", 100, "tools which can be added to the tracker per day, 0 for no limit")
+	rootCmd.PersistentFlags().Int("tool-autocorrect", 0,
+		"correct tool names within this many edits of an existing tool to it, e.g. 1 for \"scpoe 3\" to \"Scope 3\", 0 for off")
+	rootCmd.PersistentFlags().Int("tool-suggest", 0,
+		"reject tool names within this many edits of existing tools, suggesting those instead, e.g. 2, 0 for off")
+	rootCmd.PersistentFlags().Bool("registered-tools-only", false,
+		"only accept commands for tools which have been added on the web UI")
+	rootCmd.PersistentFlags().String("qr-key", "",
+		"secret to sign the QR code subjects with, then Borrowed is only accepted from QR codes (default \"\", i.e. from any subject)")
+	rootCmd.PersistentFlags().String("admin-password", "",
+		"password (with any user name) to log in to the web UI as the admin, who can register tools and print their QR codes with --qr-key (default \"\", i.e. no admin)")
 
 	rootCmd.PersistentFlags().Uint32("max-message-bytes", 1024*1024, "Maximum bytes to process per e-mail (to prevent DoS)")
 	rootCmd.PersistentFlags().Uint32("max-recipients", 10, "Maximum recipients to process per e-mail (to prevent DoS)")
@@ -61,6 +114,10 @@ checked because they are trivially forged`)
 	rootCmd.PersistentFlags().Duration("write-timeout", 10*time.Second, "Write timeout for servers")
 	rootCmd.PersistentFlags().Duration("retry", 5*time.Minute, "IMAP/SMTP retry, reports failure to web UI")
 	rootCmd.PersistentFlags().Uint32("qr-size-mm", 48, "Default QR image size for printer, in mm. For 58mm roll thermal printers, 48mm (default) is best")
+	rootCmd.PersistentFlags().String("qr-language", "",
+		"Default language for the QR code subject, from `languages` in the config file (default \"\", i.e. English)")
+	rootCmd.PersistentFlags().Bool("qr-plus-address", false,
+		"QR codes also put the command in the recipient (e.g. tooltracker+borrow.tool@domain), for mail clients which drop the subject")
 
 	viper.BindPFlags(rootCmd.PersistentFlags())
 
@@ -91,12 +148,61 @@ func initConfig() {
 	dkim = viper.GetString("dkim")
 	delegate = viper.GetBool("delegate")
 	localDkim = viper.GetBool("local-dkim")
+	authservId = viper.GetString("trust-authserv-id")
+	for _, sealer := range viper.GetStringSlice("trust-arc-sealer") {
+		arcSealers = append(arcSealers, strings.ToLower(sealer))
+	}
+	var err error
+	acceptAuth, err = mail.ParseAuthMethods(viper.GetStringSlice("accept-auth"))
+	if err != nil {
+		log.Fatalf("Bad `accept-auth`: %v", err)
+	}
+	if path := viper.GetString("smime-trust-store"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Bad `smime-trust-store`: %v", err)
+		}
+		smimeRoots = x509.NewCertPool()
+		if !smimeRoots.AppendCertsFromPEM(pem) {
+			log.Fatalf("Bad `smime-trust-store`: no certificates in %s", path)
+		}
+	}
 	domain = viper.GetString("domain")
 	from = viper.GetString("from")
 	httpPort = viper.GetInt("http-port")
 	httpPrefix = viper.GetString("http-prefix")
 	listen = viper.GetString("listen")
 	to = viper.GetString("to")
+	relay = viper.GetString("relay")
+	confirmHandover = viper.GetBool("confirm-handover")
+	confirmDelegation = viper.GetBool("confirm-delegation")
+
+	// E.g.
+	//   languages:
+	//     hu:
+	//       prefixes: [Vá]
+	//       keywords:
+	//         borrow: [Kölcsönvettem]
+	var languages map[string]mail.Language
+	if err := viper.UnmarshalKey("languages", &languages); err != nil {
+		log.Fatalf("Bad `languages` in config: %v", err)
+	}
+	mail.SetLanguages(languages)
+
+	if key := viper.GetString("qr-key"); key != "" {
+		qrKey = []byte(key)
+		if viper.GetString("admin-password") == "" {
+			log.Fatalf("`qr-key` needs an `admin-password`, only the admin can print the QR codes")
+		}
+	}
+
+	burst := viper.GetInt("rate-limit-burst")
+	rateLimits = ratelimit.Limits{
+		Ip:       ratelimit.New(viper.GetFloat64("rate-limit-ip"), burst),
+		Sender:   ratelimit.New(viper.GetFloat64("rate-limit-sender"), burst),
+		Tool:     ratelimit.New(viper.GetFloat64("rate-limit-tool"), burst),
+		NewTools: ratelimit.NewDailyCap(viper.GetInt("max-new-tools-per-day")),
+	}
 
 	limits.MaxMessageBytes = viper.GetUint32("max-message-bytes")
 	limits.MaxRecipients = viper.GetUint32("max-recipients")
@@ -104,6 +210,74 @@ func initConfig() {
 	limits.WriteTimeout = viper.GetDuration("write-timeout")
 }
 
+// How often the queue looks for e-mails due a retry
+const queuePoll = 10 * time.Second
+
+// Sender for e-mails from the tooltracker, nil if there is no relay to send
+// them through
+func newSender(accept string) mail.Sender {
+	if relay == "" {
+		if confirmHandover {
+			log.Println("--confirm-handover needs --relay to send confirmations, ignoring")
+		}
+		if confirmDelegation {
+			log.Println("--confirm-delegation needs --relay to send confirmations, ignoring")
+		}
+		return nil
+	}
+	return mail.SmtpSender{Addr: relay, From: accept}
+}
+
+// Caching resolver for the mail checks, nil to use the system's (uncached) if
+// there are no nameservers
+func newResolver() *resolver.Resolver {
+	var r *resolver.Resolver
+	if servers := viper.GetStringSlice("dns-server"); len(servers) > 0 {
+		r = resolver.New(servers)
+	} else {
+		var err error
+		r, err = resolver.FromConfig("/etc/resolv.conf")
+		if err != nil {
+			log.Printf("No --dns-server and can't read /etc/resolv.conf, not caching DNS: %v", err)
+			return nil
+		}
+	}
+	r.Timeout = viper.GetDuration("dns-timeout")
+	r.NegativeTtl = viper.GetDuration("dns-negative-ttl")
+	mail.SetResolver(r)
+	return r
+}
+
+// Queue for received e-mails, run it to process them
+func newQueue(dbConn db.DB, accept string, shutdownChan chan struct{}) *mail.Queue {
+	return &mail.Queue{
+		Session: mail.Session{
+			Db:                dbConn,
+			Sender:            newSender(accept),
+			To:                accept,
+			Dkim:              dkim,
+			Delegate:          delegate,
+			LocalDkim:         localDkim,
+			AuthservId:        authservId,
+			ArcSealers:        arcSealers,
+			SmimeRoots:        smimeRoots,
+			Accept:            acceptAuth,
+			ConfirmHandover:   confirmHandover,
+			ConfirmDelegation: confirmDelegation,
+			Limits:            rateLimits,
+			RegisteredOnly:    viper.GetBool("registered-tools-only"),
+			QrKey:             qrKey,
+			ToolAutocorrect:   viper.GetInt("tool-autocorrect"),
+			ToolSuggest:       viper.GetInt("tool-suggest"),
+		},
+		ShutdownChan: shutdownChan,
+		Workers:      viper.GetInt("workers"),
+		MaxAttempts:  viper.GetInt("max-attempts"),
+		Backoff:      viper.GetDuration("retry-backoff"),
+		Poll:         queuePoll,
+	}
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -2,38 +2,78 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/KoviRobi/tooltracker/tags"
 )
 
-type DB struct{ *sql.DB }
+// A location update is older than the one already in the database
+var ErrOutdated = errors.New("A newer location is already recorded")
+var ErrDelegatedElsewhere = errors.New("Already acting for someone else, it has to Unalias first")
+
+// How long to remember processed mails for, to skip redelivered ones
+const processedRetention = 90 * 24 * time.Hour
+
+type DB struct {
+	*sql.DB
+	// Set when inside `Transaction`, statements are then run on it instead
+	tx *sql.Tx
+}
 
 type Location struct {
-	Comment    *string
+	Comment *string
+	// When the location was sent (e.g. the mail's Date), if known, so that
+	// older mails don't overwrite newer locations
+	LastSeenAt *time.Time
+	// ID of the tool, see Tool.Id
 	Tool       string
 	LastSeenBy string
 }
 
 type Alias struct {
 	DelegatedEmail *string
-	Email          string
-	Alias          string
+	// Set while the delegation waits for Email to confirm it
+	ConfirmToken *string
+	// When the delegation stops working, nil for never
+	ExpiresAt *time.Time
+	Email     string
+	Alias     string
+}
+
+// A tool given by one person to another, waiting for the recipient to confirm
+type Handover struct {
+	Comment *string
+	Token   string
+	// ID of the tool
+	Tool string
+	From string
+	To   string
 }
 
 type Tool struct {
 	Description *string
-	Tags        tags.Tags
-	Name        string
-	Image       string
+	// Language of the QR code subject, nil for the deployment default
+	Language *string
+	Tags     tags.Tags
+	// Stable, short and safe to put in e-mails and URLs, see NewToolId
+	Id string
+	// For display, can be changed, see RenameTool
+	Name  string
+	Image string
+	// Added by an admin, so its QR codes can carry a token, see RegisterTool
+	Registered bool
 }
 
 type Item struct {
 	Tags        *[]string
 	Description *string
 	Alias       *string
+	// Name of the tool, the location has its ID
+	Name string
 	Location
 }
 
@@ -42,8 +82,12 @@ func (l Location) String() string {
 	if l.Comment != nil {
 		comment = fmt.Sprintf("%q", *l.Comment)
 	}
-	return fmt.Sprintf("Location{\n\tTool: %q\n\tLastSeenBy: %q\n\tComment: %s\n}\n",
-		l.Tool, l.LastSeenBy, comment)
+	lastSeenAt := "<nil>"
+	if l.LastSeenAt != nil {
+		lastSeenAt = l.LastSeenAt.String()
+	}
+	return fmt.Sprintf("Location{\n\tTool: %q\n\tLastSeenBy: %q\n\tLastSeenAt: %s\n\tComment: %s\n}\n",
+		l.Tool, l.LastSeenBy, lastSeenAt, comment)
 }
 
 func (a Alias) String() string {
@@ -51,8 +95,31 @@ func (a Alias) String() string {
 	if a.DelegatedEmail != nil {
 		delegatedEmail = fmt.Sprintf("%q", *a.DelegatedEmail)
 	}
-	return fmt.Sprintf("Alias{\n\tEmail: %q\n\tAlias: %q\n\tDelegatedEmail: %s\n}\n",
-		a.Email, a.Alias, delegatedEmail)
+	confirmToken := "<nil>"
+	if a.ConfirmToken != nil {
+		confirmToken = fmt.Sprintf("%q", *a.ConfirmToken)
+	}
+	expiresAt := "<nil>"
+	if a.ExpiresAt != nil {
+		expiresAt = a.ExpiresAt.String()
+	}
+	return fmt.Sprintf("Alias{\n\tEmail: %q\n\tAlias: %q\n\tDelegatedEmail: %s\n\tConfirmToken: %s\n\tExpiresAt: %s\n}\n",
+		a.Email, a.Alias, delegatedEmail, confirmToken, expiresAt)
+}
+
+// Whether the delegation is confirmed and hasn't expired
+func (a Alias) Active(now time.Time) bool {
+	return a.DelegatedEmail != nil && a.ConfirmToken == nil &&
+		(a.ExpiresAt == nil || now.Before(*a.ExpiresAt))
+}
+
+func (h Handover) String() string {
+	comment := "<nil>"
+	if h.Comment != nil {
+		comment = fmt.Sprintf("%q", *h.Comment)
+	}
+	return fmt.Sprintf("Handover{\n\tToken: %q\n\tTool: %q\n\tFrom: %q\n\tTo: %q\n\tComment: %s\n}\n",
+		h.Token, h.Tool, h.From, h.To, comment)
 }
 
 func (t Tool) String() string {
@@ -60,8 +127,12 @@ func (t Tool) String() string {
 	if t.Description != nil {
 		description = fmt.Sprintf("%q", *t.Description)
 	}
-	return fmt.Sprintf("Tool{\n\tName: %q\n\tDescription: %s\n\tImage: %.10v\n\tTags: %s\n}\n",
-		t.Name, description, t.Image, t.Tags.String())
+	language := "<nil>"
+	if t.Language != nil {
+		language = fmt.Sprintf("%q", *t.Language)
+	}
+	return fmt.Sprintf("Tool{\n\tId: %q\n\tName: %q\n\tDescription: %s\n\tLanguage: %s\n\tImage: %.10v\n\tTags: %s\n\tRegistered: %t\n}\n",
+		t.Id, t.Name, description, language, t.Image, t.Tags.String(), t.Registered)
 }
 
 func (i Item) String() string {
@@ -74,8 +145,8 @@ func (i Item) String() string {
 	if i.Alias != nil {
 		alias = fmt.Sprintf("%q", *i.Alias)
 	}
-	return fmt.Sprintf("Item{\n\tLocation: %sAlias: %s\n\tDelegatedEmail: %s\n}\n",
-		location, description, alias)
+	return fmt.Sprintf("Item{\n\tName: %q\n\tLocation: %sAlias: %s\n\tDelegatedEmail: %s\n}\n",
+		i.Name, location, description, alias)
 }
 
 // Represent "" as nil, and trim spaces.
@@ -90,120 +161,283 @@ func NormalizeStringP(s *string) *string {
 	return &trimmed
 }
 
+func (db DB) Exec(query string, args ...any) (sql.Result, error) {
+	if db.tx != nil {
+		return db.tx.Exec(query, args...)
+	}
+	return db.DB.Exec(query, args...)
+}
+
+func (db DB) Prepare(query string) (*sql.Stmt, error) {
+	if db.tx != nil {
+		return db.tx.Prepare(query)
+	}
+	return db.DB.Prepare(query)
+}
+
+func (db DB) Query(query string, args ...any) (*sql.Rows, error) {
+	if db.tx != nil {
+		return db.tx.Query(query, args...)
+	}
+	return db.DB.Query(query, args...)
+}
+
+func (db DB) QueryRow(query string, args ...any) *sql.Row {
+	if db.tx != nil {
+		return db.tx.QueryRow(query, args...)
+	}
+	return db.DB.QueryRow(query, args...)
+}
+
+// Run fn inside a transaction, committing if it returns nil and rolling back
+// otherwise. Nested transactions just reuse the outer one.
+func (db DB) Transaction(fn func(tx DB) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Failed to begin transaction: %w", err)
+	}
+	err = fn(DB{DB: db.DB, tx: tx})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		err = fmt.Errorf("Failed to commit transaction: %w", err)
+	}
+	return err
+}
+
 func (db DB) EnsureTooltrackerTables() error {
 	sqlStmt := `
-	CREATE TABLE IF NOT EXISTS tracker (tool TEXT PRIMARY KEY, lastSeenBy TEXT NOT NULL, comment TEXT);
-	CREATE TABLE IF NOT EXISTS tool (name TEXT PRIMARY KEY, description text, image TEXT);
-	CREATE TABLE IF NOT EXISTS aliases (email TEXT PRIMARY KEY, alias TEXT NOT NULL, delegatedEmail TEXT);
+	CREATE TABLE IF NOT EXISTS tracker (tool TEXT PRIMARY KEY, lastSeenBy TEXT NOT NULL, comment TEXT, lastSeenAt INTEGER);
+	CREATE TABLE IF NOT EXISTS tool (id TEXT PRIMARY KEY, name TEXT NOT NULL UNIQUE, description text, image TEXT, language TEXT, registered INTEGER NOT NULL DEFAULT 0);
+	CREATE TABLE IF NOT EXISTS aliases (email TEXT PRIMARY KEY, alias TEXT NOT NULL, delegatedEmail TEXT, confirmToken TEXT, expiresAt INTEGER);
 	CREATE TABLE IF NOT EXISTS tags (tag TEXT, tool TEXT, PRIMARY KEY (tag, tool));
+	CREATE TABLE IF NOT EXISTS processed (id TEXT PRIMARY KEY, processedAt INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS toolAliases (alias TEXT PRIMARY KEY, tool TEXT NOT NULL);
+	CREATE TABLE IF NOT EXISTS handovers (token TEXT PRIMARY KEY, tool TEXT NOT NULL, fromEmail TEXT NOT NULL, toEmail TEXT NOT NULL, comment TEXT);
+	CREATE TABLE IF NOT EXISTS pgpKeys (email TEXT PRIMARY KEY, fingerprint TEXT NOT NULL, armored TEXT NOT NULL, addedBy TEXT NOT NULL, addedAt INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS pendingPgpKeys (token TEXT PRIMARY KEY, email TEXT NOT NULL, fingerprint TEXT NOT NULL, armored TEXT NOT NULL, addedBy TEXT NOT NULL, addedAt INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS imapState (mailbox TEXT PRIMARY KEY, uidValidity INTEGER NOT NULL, lastUid INTEGER NOT NULL);
+	CREATE TABLE IF NOT EXISTS inbox (id INTEGER PRIMARY KEY, mailFrom TEXT NOT NULL, rcpt TEXT NOT NULL, clientIp TEXT, helo TEXT, raw BLOB NOT NULL, receivedAt INTEGER NOT NULL, nextAttemptAt INTEGER NOT NULL, attempts INTEGER NOT NULL, lastError TEXT, verification TEXT, state TEXT NOT NULL);
 	`
 	_, err := db.Exec(sqlStmt)
+	if err == nil {
+		err = db.ensureColumn("tool", "language", "TEXT")
+	}
+	if err == nil {
+		err = db.ensureColumn("tracker", "lastSeenAt", "INTEGER")
+	}
+	if err == nil {
+		err = db.ensureColumn("inbox", "verification", "TEXT")
+	}
+	if err == nil {
+		err = db.ensureColumn("inbox", "clientIp", "TEXT")
+	}
+	if err == nil {
+		err = db.ensureColumn("inbox", "helo", "TEXT")
+	}
+	if err == nil {
+		err = db.ensureColumn("aliases", "confirmToken", "TEXT")
+	}
+	if err == nil {
+		err = db.ensureColumn("aliases", "expiresAt", "INTEGER")
+	}
+	if err == nil {
+		err = db.migrateToolIds()
+	}
+	if err == nil {
+		err = db.ensureColumn("tool", "registered", "INTEGER NOT NULL DEFAULT 0")
+	}
 	if err != nil {
 		err = fmt.Errorf("Failed to initialise database: %w", err)
 	}
 	return err
 }
 
-func (db DB) UpdateLocation(location Location) {
+// Add a column to a table created by an older version of the tooltracker
+func (db DB) ensureColumn(table, column, definition string) error {
+	_, err := db.Exec(fmt.Sprintf(`SELECT %s FROM %s LIMIT 0`, column, table))
+	if err == nil {
+		return nil
+	}
+	log.Printf("Adding column %s to table %s", column, table)
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
+// Returns ErrOutdated if the database has a newer location for the tool
+func (db DB) UpdateLocation(location Location) error {
 	stmt, err := db.Prepare(`
-	INSERT INTO tracker (tool, lastSeenBy, comment) VALUES (?, ?, ?)
+	INSERT INTO tracker (tool, lastSeenBy, comment, lastSeenAt) VALUES (?, ?, ?, ?)
 		ON CONFLICT(tool) DO UPDATE SET
 			lastSeenBy=excluded.lastSeenBy,
-			comment=excluded.comment`)
+			comment=excluded.comment,
+			lastSeenAt=coalesce(excluded.lastSeenAt, tracker.lastSeenAt)
+		WHERE excluded.lastSeenAt IS NULL
+			OR tracker.lastSeenAt IS NULL
+			OR excluded.lastSeenAt >= tracker.lastSeenAt`)
 	if err != nil {
-		log.Printf("Error preparing query: %v", err)
+		return fmt.Errorf("Error preparing query: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(
+	var lastSeenAt *int64
+	if location.LastSeenAt != nil {
+		unix := location.LastSeenAt.Unix()
+		lastSeenAt = &unix
+	}
+	res, err := stmt.Exec(
 		strings.TrimSpace(location.Tool),
 		strings.TrimSpace(location.LastSeenBy),
 		NormalizeStringP(location.Comment),
+		lastSeenAt,
 	)
 	if err != nil {
-		log.Fatal("Error executing database query: $v", err)
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrOutdated
 	}
+	return nil
 }
 
-func (db DB) UpdateTool(tool Tool) {
-	stmt, err := db.Prepare(`
-	INSERT INTO tool (name, description, image) VALUES (?, ?, ?)
-		ON CONFLICT(name) DO UPDATE SET
-			description=excluded.description,
-			image=excluded.image`)
+// Record that a mail has been processed. Returns false if it already has
+// been, e.g. it has been redelivered.
+func (db DB) MarkProcessed(id string) (bool, error) {
+	now := time.Now()
+	_, err := db.Exec(`DELETE FROM processed WHERE processedAt < ?`,
+		now.Add(-processedRetention).Unix())
 	if err != nil {
-		log.Printf("Error preparing query: %v", err)
+		return false, fmt.Errorf("Error pruning processed mails: %w", err)
 	}
-	defer stmt.Close()
 
-	name := strings.TrimSpace(tool.Name)
-	_, err = stmt.Exec(
-		name,
+	res, err := db.Exec(`
+	INSERT INTO processed (id, processedAt) VALUES (?, ?)
+		ON CONFLICT(id) DO NOTHING`,
+		id, now.Unix())
+	if err != nil {
+		return false, fmt.Errorf("Error executing query: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Error getting affected rows: %w", err)
+	}
+	return n == 1, nil
+}
+
+// Update the description, image, language and tags of the tool (by its ID),
+// see RenameTool for the name
+func (db DB) UpdateTool(tool Tool) error {
+	res, err := db.Exec(`UPDATE tool SET description = ?, image = ?, language = ? WHERE id = ?`,
 		NormalizeStringP(tool.Description),
 		tool.Image,
-	)
+		NormalizeStringP(tool.Language),
+		tool.Id)
 	if err != nil {
-		log.Printf("Error executing query: %v", err)
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w %q", ErrNoSuchTool, tool.Id)
 	}
 
-	db.UpdateTags(name, tool.Tags)
+	return db.UpdateTags(tool.Id, tool.Tags)
 }
 
-func (db DB) UpdateTags(tool string, tags tags.Tags) {
+func (db DB) UpdateTags(tool string, tags tags.Tags) error {
 	_, err := db.Exec(`DELETE FROM tags WHERE tags.tool = ?`, tool)
 	if err != nil {
-		log.Printf("Error dropping previous tags: %v", err)
+		return fmt.Errorf("Error dropping previous tags: %w", err)
 	}
 	stmt, err := db.Prepare(`
 	INSERT INTO tags (tag, tool) VALUES (?, ?)`)
 	if err != nil {
-		log.Printf("Error preparing query: %v", err)
+		return fmt.Errorf("Error preparing query: %w", err)
 	}
 	defer stmt.Close()
 
 	for tag, tagType := range tags {
 		_, err = stmt.Exec(string(tagType)+tag, tool)
 		if err != nil {
-			log.Printf("Error executing query: %v", err)
+			return fmt.Errorf("Error executing query: %w", err)
 		}
 	}
+	return nil
 }
 
-func (db DB) UpdateAlias(alias Alias) {
+// Without a DelegatedEmail, only the alias is updated, otherwise the
+// delegation (with its ConfirmToken and ExpiresAt) is replaced too. Returns
+// ErrDelegatedElsewhere instead of replacing another address's delegation,
+// unless it has expired.
+func (db DB) UpdateAlias(alias Alias) error {
 	stmt, err := db.Prepare(`
-	INSERT INTO aliases (email, alias, delegatedEmail) VALUES (?, ?, ?)
+	INSERT INTO aliases (email, alias, delegatedEmail, confirmToken, expiresAt) VALUES (?, ?, ?, ?, ?)
 		ON CONFLICT(email) DO UPDATE SET
 			alias=excluded.alias,
-			delegatedEmail=coalesce(excluded.delegatedEmail, delegatedEmail)`)
+			confirmToken=CASE WHEN excluded.delegatedEmail IS NULL
+				THEN aliases.confirmToken ELSE excluded.confirmToken END,
+			expiresAt=CASE WHEN excluded.delegatedEmail IS NULL
+				THEN aliases.expiresAt ELSE excluded.expiresAt END,
+			delegatedEmail=coalesce(excluded.delegatedEmail, aliases.delegatedEmail)
+		WHERE excluded.delegatedEmail IS NULL OR aliases.delegatedEmail IS NULL
+			OR lower(aliases.delegatedEmail) = lower(excluded.delegatedEmail)
+			OR aliases.expiresAt <= ?`)
 	if err != nil {
-		log.Printf("Error preparing query: %v", err)
+		return fmt.Errorf("Error preparing query: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(
+	var expiresAt *int64
+	if alias.ExpiresAt != nil {
+		unix := alias.ExpiresAt.Unix()
+		expiresAt = &unix
+	}
+	result, err := stmt.Exec(
 		strings.TrimSpace(alias.Email),
 		strings.TrimSpace(alias.Alias),
-		NormalizeStringP(alias.DelegatedEmail))
+		NormalizeStringP(alias.DelegatedEmail),
+		alias.ConfirmToken,
+		expiresAt,
+		time.Now().Unix())
 	if err != nil {
-		log.Printf("Error executing query: %v", err)
+		return fmt.Errorf("Error executing query: %w", err)
 	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrDelegatedElsewhere
+	}
+	return nil
+}
+
+// The tool with the ID, with an empty Id if there is no such tool
+func (db DB) GetTool(id string) Tool {
+	return db.getTool(`tool.id = ?`, strings.TrimSpace(id))
+}
+
+// The tool currently called name, with an empty Id if there is no such tool
+func (db DB) GetToolByName(name string) Tool {
+	return db.getTool(`tool.name = ?`, strings.TrimSpace(name))
 }
 
-func (db DB) GetTool(name string) (tool Tool) {
+func (db DB) getTool(where string, arg string) (tool Tool) {
 	stmt, err := db.Prepare(`
-		SELECT tool.name, string_agg(tags.tag, " "), tool.description, tool.image
+		SELECT tool.id, tool.name, string_agg(tags.tag, " "), tool.description, tool.image, tool.language, tool.registered
 		FROM tool
-		LEFT JOIN tags ON tool.name = tags.tool
-		WHERE tool.name = ?
-		GROUP BY tool.name
+		LEFT JOIN tags ON tool.id = tags.tool
+		WHERE ` + where + `
+		GROUP BY tool.id
 		`)
 	if err != nil {
 		log.Printf("Error preparing query: %v", err)
+		return
 	}
 	defer stmt.Close()
 
 	var itemTags *string
-	err = stmt.QueryRow(name).Scan(&tool.Name, &itemTags, &tool.Description, &tool.Image)
+	err = stmt.QueryRow(arg).Scan(&tool.Id, &tool.Name, &itemTags, &tool.Description, &tool.Image, &tool.Language, &tool.Registered)
 	if err != nil && err != sql.ErrNoRows {
 		log.Printf("Error getting rows from query: %v", err)
 	}
@@ -213,6 +447,28 @@ func (db DB) GetTool(name string) (tool Tool) {
 	return
 }
 
+// The names of all the tools
+func (db DB) GetToolNames() []string {
+	rows, err := db.Query(`SELECT name FROM tool`)
+	if err != nil {
+		log.Printf("Error executing query: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			log.Printf("Error getting row from query: %v", err)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
 func (db DB) GetItems(filter tags.Tags) []Item {
 	var items []Item
 
@@ -222,10 +478,10 @@ func (db DB) GetItems(filter tags.Tags) []Item {
 		where, args = tags.TagsSqlFilter(filter)
 	}
 	query := `
-	SELECT tracker.tool, string_agg(tags.tag, " "), tool.description, tracker.lastSeenBy, aliases.alias, tracker.comment
+	SELECT tracker.tool, coalesce(tool.name, tracker.tool), string_agg(tags.tag, " "), tool.description, tracker.lastSeenBy, aliases.alias, tracker.comment
 		FROM tracker
 		LEFT JOIN tags ON tracker.tool = tags.tool
-		LEFT JOIN tool ON tool.name = tracker.tool
+		LEFT JOIN tool ON tool.id = tracker.tool
 		LEFT JOIN aliases ON aliases.email = tracker.lastSeenBy
 		` + where + `
 		GROUP BY tracker.tool`
@@ -238,7 +494,7 @@ func (db DB) GetItems(filter tags.Tags) []Item {
 	var itemTags *string
 	for rows.Next() {
 		var item Item
-		err = rows.Scan(&item.Tool, &itemTags, &item.Description, &item.LastSeenBy, &item.Alias, &item.Comment)
+		err = rows.Scan(&item.Tool, &item.Name, &itemTags, &item.Description, &item.LastSeenBy, &item.Alias, &item.Comment)
 		if err != nil {
 			log.Printf("Error getting row from query: %v", err)
 			continue
@@ -253,16 +509,19 @@ func (db DB) GetItems(filter tags.Tags) []Item {
 	return items
 }
 
+// Who the e-mail acts for, itself unless it has a confirmed and unexpired
+// delegation
 func (db DB) GetDelegatedEmailFor(from string) string {
 	var delegate sql.NullString
-	stmt, err := db.Prepare(
-		`SELECT delegatedEmail FROM aliases WHERE email = ?`)
+	stmt, err := db.Prepare(`
+	SELECT delegatedEmail FROM aliases
+		WHERE email = ? AND confirmToken IS NULL AND (expiresAt IS NULL OR expiresAt > ?)`)
 	if err != nil {
 		log.Printf("Error preparing query: %v", err)
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(from).Scan(&delegate)
+	err = stmt.QueryRow(from, time.Now().Unix()).Scan(&delegate)
 	if err != nil && err != sql.ErrNoRows {
 		log.Printf("Error getting row from query: %v", err)
 		return from
@@ -273,3 +532,138 @@ func (db DB) GetDelegatedEmailFor(from string) string {
 		return from
 	}
 }
+
+// Find the e-mails which have the given alias (ignoring case)
+func (db DB) GetEmailsForAlias(alias string) []string {
+	var emails []string
+	rows, err := db.Query(
+		`SELECT email FROM aliases WHERE lower(alias) = lower(?)`,
+		strings.TrimSpace(alias))
+	if err != nil {
+		log.Printf("Error executing query: %v", err)
+		return emails
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			log.Printf("Error getting row from query: %v", err)
+			continue
+		}
+		emails = append(emails, email)
+	}
+
+	return emails
+}
+
+func scanAlias(scan func(dest ...any) error) (Alias, error) {
+	var alias Alias
+	var expiresAt sql.NullInt64
+	err := scan(&alias.Email, &alias.Alias, &alias.DelegatedEmail, &alias.ConfirmToken, &expiresAt)
+	if expiresAt.Valid {
+		expires := time.Unix(expiresAt.Int64, 0)
+		alias.ExpiresAt = &expires
+	}
+	return alias, err
+}
+
+// The delegation waiting for confirmation with the token, nil if there isn't
+// one
+func (db DB) GetPendingDelegation(token string) *Alias {
+	alias, err := scanAlias(db.QueryRow(`
+	SELECT email, alias, delegatedEmail, confirmToken, expiresAt FROM aliases
+		WHERE confirmToken = ? AND delegatedEmail IS NOT NULL`,
+		token).Scan)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Printf("Error getting row from query: %v", err)
+		return nil
+	}
+	return &alias
+}
+
+// Activate the delegation waiting for confirmation with the token
+func (db DB) ConfirmDelegation(token string) error {
+	_, err := db.Exec(`UPDATE aliases SET confirmToken = NULL WHERE confirmToken = ?`, token)
+	if err != nil {
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	return nil
+}
+
+// Remove the delegation of the e-mail, if delegatedEmail isn't nil then only
+// if it is to that. Returns whether there was such a delegation.
+func (db DB) RevokeDelegation(email string, delegatedEmail *string) (bool, error) {
+	result, err := db.Exec(`
+	UPDATE aliases SET delegatedEmail = NULL, confirmToken = NULL, expiresAt = NULL
+		WHERE lower(email) = lower(?) AND delegatedEmail IS NOT NULL
+			AND (? IS NULL OR lower(delegatedEmail) = lower(?))`,
+		strings.TrimSpace(email), delegatedEmail, delegatedEmail)
+	if err != nil {
+		return false, fmt.Errorf("Error executing query: %w", err)
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Error executing query: %w", err)
+	}
+	return changed > 0, nil
+}
+
+// All the delegations, including pending and expired ones
+func (db DB) GetDelegations() []Alias {
+	rows, err := db.Query(`
+	SELECT email, alias, delegatedEmail, confirmToken, expiresAt FROM aliases
+		WHERE delegatedEmail IS NOT NULL ORDER BY delegatedEmail, email`)
+	if err != nil {
+		log.Printf("Error executing query: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var aliases []Alias
+	for rows.Next() {
+		alias, err := scanAlias(rows.Scan)
+		if err != nil {
+			log.Printf("Error getting row from query: %v", err)
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases
+}
+
+func (db DB) AddHandover(handover Handover) error {
+	_, err := db.Exec(`
+	INSERT INTO handovers (token, tool, fromEmail, toEmail, comment) VALUES (?, ?, ?, ?, ?)`,
+		handover.Token,
+		strings.TrimSpace(handover.Tool),
+		strings.TrimSpace(handover.From),
+		strings.TrimSpace(handover.To),
+		NormalizeStringP(handover.Comment))
+	if err != nil {
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	return nil
+}
+
+// Get and remove the handover, returns nil if there is no such handover
+func (db DB) TakeHandover(token string) (*Handover, error) {
+	handover := Handover{Token: token}
+	err := db.QueryRow(
+		`SELECT tool, fromEmail, toEmail, comment FROM handovers WHERE token = ?`,
+		token).Scan(&handover.Tool, &handover.From, &handover.To, &handover.Comment)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error getting row from query: %w", err)
+	}
+
+	_, err = db.Exec(`DELETE FROM handovers WHERE token = ?`, token)
+	if err != nil {
+		return nil, fmt.Errorf("Error executing query: %w", err)
+	}
+	return &handover, nil
+}
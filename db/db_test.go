@@ -4,9 +4,13 @@ package db
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/KoviRobi/tooltracker/tags"
 	"github.com/KoviRobi/tooltracker/test_utils"
@@ -27,13 +31,13 @@ func ExecAssert(t *testing.T, db DB, query string, args ...any) sql.Result {
 func TestSql(t *testing.T) {
 	db := CommonInit(t)
 
-	ExecAssert(t, db, `INSERT INTO tracker VALUES('tool1', 'user1@com.com', NULL);`)
-	ExecAssert(t, db, `INSERT INTO tracker VALUES('tool2', 'user1@com.com', 'Comment');`)
-	ExecAssert(t, db, `INSERT INTO tracker VALUES('tool3', 'user2@com.com', NULL);`)
+	ExecAssert(t, db, `INSERT INTO tracker (tool, lastSeenBy, comment) VALUES('tool1', 'user1@com.com', NULL);`)
+	ExecAssert(t, db, `INSERT INTO tracker (tool, lastSeenBy, comment) VALUES('tool2', 'user1@com.com', 'Comment');`)
+	ExecAssert(t, db, `INSERT INTO tracker (tool, lastSeenBy, comment) VALUES('tool3', 'user2@com.com', NULL);`)
 
-	ExecAssert(t, db, `INSERT INTO tool VALUES('tool1', NULL,'');`)
-	ExecAssert(t, db, `INSERT INTO tool VALUES('tool2', NULL,'');`)
-	ExecAssert(t, db, `INSERT INTO tool VALUES('tool3', NULL,'');`)
+	ExecAssert(t, db, `INSERT INTO tool (id, name, description, image) VALUES('tool1', 'Tool 1', NULL,'');`)
+	ExecAssert(t, db, `INSERT INTO tool (id, name, description, image) VALUES('tool2', 'Tool 2', NULL,'');`)
+	ExecAssert(t, db, `INSERT INTO tool (id, name, description, image) VALUES('tool3', 'Tool 3', NULL,'');`)
 
 	ExecAssert(t, db, `INSERT INTO tags VALUES('tag1', 'tool1');`)
 	ExecAssert(t, db, `INSERT INTO tags VALUES('tag2', 'tool1');`)
@@ -48,6 +52,7 @@ func TestSql(t *testing.T) {
 	expected := []Item{
 		{
 			Location: Location{Tool: "tool2", LastSeenBy: "user1@com.com", Comment: &comment},
+			Name:     "Tool 2",
 			Tags:     &[]string{"tag2", "tag3"},
 		},
 	}
@@ -56,3 +61,188 @@ func TestSql(t *testing.T) {
 	slices.SortFunc(expected, toolCmp)
 	test_utils.AssertSlicesEqual(t, expected, items)
 }
+
+func TestRenameTool(t *testing.T) {
+	db := CommonInit(t)
+
+	older := time.Unix(1000, 0)
+	newer := time.Unix(2000, 0)
+	description := "Rigol"
+	scope, err := db.AddTool("scope")
+	test_utils.Assert(t, err)
+	scope.Description = &description
+	scope.Image = "aW1hZ2U="
+	scope.Tags = Tags{"tag1": Any}
+	test_utils.Assert(t, db.UpdateLocation(Location{Tool: scope.Id, LastSeenBy: "user1@com.com", LastSeenAt: &newer}))
+	test_utils.Assert(t, db.UpdateTool(scope))
+	scope1, err := db.AddTool("Scope 1")
+	test_utils.Assert(t, err)
+	scope1.Tags = Tags{"tag2": Any}
+	test_utils.Assert(t, db.UpdateLocation(Location{Tool: scope1.Id, LastSeenBy: "user2@com.com", LastSeenAt: &older}))
+	test_utils.Assert(t, db.UpdateTool(scope1))
+
+	// Rename, then merge the duplicate into it
+	id, err := db.RenameTool(scope1.Id, "Scope 2")
+	test_utils.Assert(t, err)
+	if id != scope1.Id {
+		t.Errorf("Expected renaming to keep the ID %q, got %q", scope1.Id, id)
+	}
+	id, err = db.RenameTool(scope.Id, "Scope 2")
+	test_utils.Assert(t, err)
+	if id != scope1.Id {
+		t.Errorf("Expected merging to give the ID %q, got %q", scope1.Id, id)
+	}
+
+	tool := db.GetToolByName("Scope 2")
+	if tool.Id != scope1.Id {
+		t.Errorf("Expected the merged tool to keep its ID %q, got %v", scope1.Id, tool)
+	}
+	if tool.Description == nil || *tool.Description != description || tool.Image != "aW1hZ2U=" {
+		t.Errorf("Expected the description and image to be merged, got %v", tool)
+	}
+	if !maps.Equal(tool.Tags, Tags{"tag1": Any, "tag2": Any}) {
+		t.Errorf("Expected the tags to be combined, got %v", tool.Tags)
+	}
+	items := db.GetItems(nil)
+	if len(items) != 1 || items[0].Name != "Scope 2" || items[0].LastSeenBy != "user1@com.com" {
+		t.Errorf("Expected the newer location, got %v", items)
+	}
+	test_utils.AssertStringSlicesEqual(t, []string{"Scope 2"}, db.GetToolNames())
+
+	expected := []ToolAlias{
+		{Alias: "Scope 1", Tool: scope1.Id},
+		{Alias: "scope", Tool: scope1.Id},
+		{Alias: scope.Id, Tool: scope1.Id},
+	}
+	slices.SortFunc(expected, func(a, b ToolAlias) int { return strings.Compare(a.Alias, b.Alias) })
+	test_utils.AssertSlicesEqual(t, expected, db.GetToolAliases())
+	for _, alias := range expected {
+		if found := db.FindTool(alias.Alias); found != scope1.Id {
+			t.Errorf("Expected %q to find %q, got %q", alias.Alias, scope1.Id, found)
+		}
+	}
+
+	// Back to an old name
+	_, err = db.RenameTool(scope1.Id, "Scope 1")
+	test_utils.Assert(t, err)
+	expected = []ToolAlias{
+		{Alias: "Scope 2", Tool: scope1.Id},
+		{Alias: "scope", Tool: scope1.Id},
+		{Alias: scope.Id, Tool: scope1.Id},
+	}
+	slices.SortFunc(expected, func(a, b ToolAlias) int { return strings.Compare(a.Alias, b.Alias) })
+	test_utils.AssertSlicesEqual(t, expected, db.GetToolAliases())
+
+	if _, err := db.RenameTool("nothing", "Scope 1"); !errors.Is(err, ErrNoSuchTool) {
+		t.Errorf("Expected %v, got %v", ErrNoSuchTool, err)
+	}
+}
+
+func TestMigrateToolIds(t *testing.T) {
+	db := CommonInit(t)
+
+	// As created by tooltrackers before tool IDs
+	ExecAssert(t, db, `DROP TABLE tool`)
+	ExecAssert(t, db, `CREATE TABLE tool (name TEXT PRIMARY KEY, description text, image TEXT, language TEXT)`)
+	ExecAssert(t, db, `INSERT INTO tool (name, description, image) VALUES('tool1', 'Described', 'aW1hZ2U=')`)
+	ExecAssert(t, db, `INSERT INTO tags VALUES('tag1', 'tool1')`)
+	ExecAssert(t, db, `INSERT INTO tracker (tool, lastSeenBy) VALUES('tool1', 'user1@com.com')`)
+	ExecAssert(t, db, `INSERT INTO tracker (tool, lastSeenBy) VALUES('tool2', 'user2@com.com')`)
+	ExecAssert(t, db, `INSERT INTO toolAliases (alias, tool) VALUES('old tool2', 'tool2')`)
+
+	test_utils.Assert(t, db.EnsureTooltrackerTables())
+
+	tool1 := db.GetToolByName("tool1")
+	if tool1.Id == "" || tool1.Description == nil || *tool1.Description != "Described" ||
+		tool1.Image != "aW1hZ2U=" || !maps.Equal(tool1.Tags, Tags{"tag1": Any}) {
+		t.Errorf("Expected tool1 to be migrated, got %v", tool1)
+	}
+	tool2 := db.GetToolByName("tool2")
+	if tool2.Id == "" || tool2.Id == tool1.Id {
+		t.Errorf("Expected tool2 to get its own ID, got %v", tool2)
+	}
+	if found := db.FindTool("old tool2"); found != tool2.Id {
+		t.Errorf("Expected the alias to be migrated to %q, got %q", tool2.Id, found)
+	}
+
+	expected := []Item{
+		{
+			Location:    Location{Tool: tool1.Id, LastSeenBy: "user1@com.com"},
+			Name:        "tool1",
+			Description: tool1.Description,
+			Tags:        &[]string{"tag1"},
+		},
+		{
+			Location: Location{Tool: tool2.Id, LastSeenBy: "user2@com.com"},
+			Name:     "tool2",
+		},
+	}
+	items := db.GetItems(nil)
+	nameCmp := func(a, b Item) int { return strings.Compare(a.Name, b.Name) }
+	slices.SortFunc(items, nameCmp)
+	test_utils.AssertSlicesEqual(t, expected, items)
+}
+
+func TestImapState(t *testing.T) {
+	db := CommonInit(t)
+
+	mailbox := "user@host/INBOX"
+	test_utils.AssertSlicesEqual(t, []ImapState{{Mailbox: mailbox}}, []ImapState{db.GetImapState(mailbox)})
+
+	state := ImapState{Mailbox: mailbox, UidValidity: 1234, LastUid: 5}
+	test_utils.Assert(t, db.UpdateImapState(state))
+	state.LastUid = 7
+	test_utils.Assert(t, db.UpdateImapState(state))
+	test_utils.AssertSlicesEqual(t, []ImapState{state}, []ImapState{db.GetImapState(mailbox)})
+}
+
+func TestDiscardQueued(t *testing.T) {
+	db := CommonInit(t)
+
+	waiting, err := db.Enqueue(QueuedMail{From: "user1@example.com", Raw: []byte("Subject: x\r\n\r\n")})
+	test_utils.Assert(t, err)
+	quarantined, err := db.Enqueue(QueuedMail{From: "user2@example.com", Raw: []byte("Subject: y\r\n\r\n")})
+	test_utils.Assert(t, err)
+	test_utils.Assert(t, db.Quarantine(quarantined, "Bad command", ""))
+
+	if err := db.DiscardQueued(waiting); !errors.Is(err, ErrNotDiscardable) {
+		t.Fatalf("Expected %v, got %v", ErrNotDiscardable, err)
+	}
+	test_utils.Assert(t, db.DiscardQueued(quarantined))
+
+	var ids []string
+	for _, queued := range db.GetQueue(QueueWaiting, QueueQuarantined) {
+		ids = append(ids, fmt.Sprint(queued.Id))
+	}
+	test_utils.AssertStringSlicesEqual(t, []string{fmt.Sprint(waiting)}, ids)
+}
+
+func TestRegisterTool(t *testing.T) {
+	db := CommonInit(t)
+
+	tool, err := db.AddTool("scope")
+	test_utils.Assert(t, err)
+	if db.GetTool(tool.Id).Registered {
+		t.Fatal("Expected a new tool not to be registered")
+	}
+	test_utils.Assert(t, db.RegisterTool(tool.Id))
+	if !db.GetTool(tool.Id).Registered {
+		t.Error("Expected the tool to be registered")
+	}
+	if err := db.RegisterTool("nosuchid"); !errors.Is(err, ErrNoSuchTool) {
+		t.Errorf("Expected %v, got %v", ErrNoSuchTool, err)
+	}
+}
+
+func TestAddToolName(t *testing.T) {
+	db := CommonInit(t)
+
+	if _, err := db.AddTool(" -- "); !errors.Is(err, ErrNoName) {
+		t.Errorf("Expected %v, got %v", ErrNoName, err)
+	}
+	cpp, err := db.AddTool("C++")
+	test_utils.Assert(t, err)
+	if _, err := db.RenameTool(cpp.Id, "#"); !errors.Is(err, ErrNoName) {
+		t.Errorf("Expected %v, got %v", ErrNoName, err)
+	}
+}
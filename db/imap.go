@@ -0,0 +1,48 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Where the IMAP receiver got up to in a mailbox, so that it only fetches new
+// mail, see imap.Session. The UIDs are only meaningful for the same
+// UidValidity.
+type ImapState struct {
+	// Identifies the account and mailbox, e.g. "user@host/INBOX"
+	Mailbox     string
+	UidValidity uint32
+	// The last message processed, 0 for none
+	LastUid uint32
+}
+
+func (s ImapState) String() string {
+	return fmt.Sprintf("ImapState{\n\tMailbox: %q\n\tUidValidity: %d\n\tLastUid: %d\n}\n",
+		s.Mailbox, s.UidValidity, s.LastUid)
+}
+
+// The state of the mailbox, with zero UidValidity and LastUid if it hasn't
+// been fetched yet
+func (db DB) GetImapState(mailbox string) ImapState {
+	state := ImapState{Mailbox: mailbox}
+	err := db.QueryRow(`SELECT uidValidity, lastUid FROM imapState WHERE mailbox = ?`,
+		mailbox).Scan(&state.UidValidity, &state.LastUid)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting row from query: %v", err)
+	}
+	return state
+}
+
+func (db DB) UpdateImapState(state ImapState) error {
+	_, err := db.Exec(`
+	INSERT INTO imapState (mailbox, uidValidity, lastUid) VALUES (?, ?, ?)
+		ON CONFLICT(mailbox) DO UPDATE SET
+			uidValidity=excluded.uidValidity,
+			lastUid=excluded.lastUid`,
+		state.Mailbox, state.UidValidity, state.LastUid)
+	if err != nil {
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	return nil
+}
@@ -18,7 +18,7 @@ func Open(path string) (DB, error) {
 	if err != nil {
 		return DB{}, err
 	}
-	return DB{db}, nil
+	return DB{DB: db}, nil
 }
 
 func (db *DB) Close() {
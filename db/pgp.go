@@ -0,0 +1,154 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// OpenPGP public keys, so that users outside the --dkim domain can sign their
+// commands instead. Keys are pending until the address confirms them, see
+// mail.Session.RequestPgpKey.
+
+type PgpKey struct {
+	AddedAt time.Time
+	// Lower case
+	Email       string
+	Fingerprint string
+	// ASCII armored
+	Key string
+	// Who registered it, e.g. the work address which sent the Alias, or "web"
+	AddedBy string
+}
+
+func (k PgpKey) String() string {
+	return fmt.Sprintf("PgpKey{\n\tEmail: %q\n\tFingerprint: %q\n\tAddedBy: %q\n}\n",
+		k.Email, k.Fingerprint, k.AddedBy)
+}
+
+// Add or replace the key for the e-mail
+func (db DB) UpdatePgpKey(key PgpKey) error {
+	_, err := db.Exec(`
+	INSERT INTO pgpKeys (email, fingerprint, armored, addedBy, addedAt) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(email) DO UPDATE SET
+			fingerprint=excluded.fingerprint,
+			armored=excluded.armored,
+			addedBy=excluded.addedBy,
+			addedAt=excluded.addedAt`,
+		strings.ToLower(strings.TrimSpace(key.Email)),
+		key.Fingerprint,
+		key.Key,
+		key.AddedBy,
+		time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	return nil
+}
+
+// The key for the e-mail, nil if there isn't one
+func (db DB) GetPgpKey(email string) *PgpKey {
+	var key PgpKey
+	var addedAt int64
+	err := db.QueryRow(`
+	SELECT email, fingerprint, armored, addedBy, addedAt FROM pgpKeys WHERE email = ?`,
+		strings.ToLower(strings.TrimSpace(email))).Scan(
+		&key.Email, &key.Fingerprint, &key.Key, &key.AddedBy, &addedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Printf("Error getting row from query: %v", err)
+		return nil
+	}
+	key.AddedAt = time.Unix(addedAt, 0)
+	return &key
+}
+
+// All the keys, without the armored key
+func (db DB) GetPgpKeys() []PgpKey {
+	rows, err := db.Query(`
+	SELECT email, fingerprint, addedBy, addedAt FROM pgpKeys ORDER BY email`)
+	if err != nil {
+		log.Printf("Error executing query: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var keys []PgpKey
+	for rows.Next() {
+		var key PgpKey
+		var addedAt int64
+		err := rows.Scan(&key.Email, &key.Fingerprint, &key.AddedBy, &addedAt)
+		if err != nil {
+			log.Printf("Error getting row from query: %v", err)
+			continue
+		}
+		key.AddedAt = time.Unix(addedAt, 0)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (db DB) DeletePgpKey(email string) error {
+	_, err := db.Exec(`DELETE FROM pgpKeys WHERE email = ?`,
+		strings.ToLower(strings.TrimSpace(email)))
+	if err != nil {
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	return nil
+}
+
+// Store the key until the e-mail confirms it with the token, see ConfirmPgpKey
+func (db DB) AddPendingPgpKey(token string, key PgpKey) error {
+	_, err := db.Exec(`
+	INSERT INTO pendingPgpKeys (token, email, fingerprint, armored, addedBy, addedAt) VALUES (?, ?, ?, ?, ?, ?)`,
+		token,
+		strings.ToLower(strings.TrimSpace(key.Email)),
+		key.Fingerprint,
+		key.Key,
+		key.AddedBy,
+		time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	return nil
+}
+
+// The key waiting for confirmation with the token, nil if there isn't one
+func (db DB) GetPendingPgpKey(token string) *PgpKey {
+	var key PgpKey
+	var addedAt int64
+	err := db.QueryRow(`
+	SELECT email, fingerprint, armored, addedBy, addedAt FROM pendingPgpKeys WHERE token = ?`,
+		token).Scan(&key.Email, &key.Fingerprint, &key.Key, &key.AddedBy, &addedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Printf("Error getting row from query: %v", err)
+		return nil
+	}
+	key.AddedAt = time.Unix(addedAt, 0)
+	return &key
+}
+
+// Activate the key waiting for confirmation with the token, replacing the
+// e-mail's current key
+func (db DB) ConfirmPgpKey(token string) error {
+	return db.Transaction(func(tx DB) error {
+		key := tx.GetPendingPgpKey(token)
+		if key == nil {
+			return nil
+		}
+		err := tx.UpdatePgpKey(*key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM pendingPgpKeys WHERE token = ?`, token)
+		if err != nil {
+			return fmt.Errorf("Error executing query: %w", err)
+		}
+		return nil
+	})
+}
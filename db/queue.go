@@ -0,0 +1,246 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Mails received but not yet processed, so that a failure while processing
+// doesn't lose them. See mail.Queue.
+
+type QueueState string
+
+const (
+	QueueWaiting    QueueState = "waiting"
+	QueueProcessing QueueState = "processing"
+	// Failed too many times, kept for an admin to look at
+	QueueDead QueueState = "dead"
+	// Rejected, e.g. failed DKIM or a bad command, kept for an admin to look at
+	QueueQuarantined QueueState = "quarantined"
+)
+
+// Quarantined mails are mostly spam, so they don't need to be kept forever
+const quarantineRetention = 30 * 24 * time.Hour
+
+type QueuedMail struct {
+	Raw []byte
+	// Also the reason for quarantine
+	LastError *string
+	// Results of checking the sender, e.g. DKIM signatures
+	Verification *string
+	ReceivedAt   time.Time
+	From         string
+	// Envelope recipient, can be empty
+	Rcpt string
+	// SMTP client's IP and HELO, for SPF, empty if unknown (e.g. IMAP)
+	ClientIp string
+	Helo     string
+	State    QueueState
+	Id       int64
+	Attempts int
+}
+
+func (q QueuedMail) String() string {
+	lastError := "<nil>"
+	if q.LastError != nil {
+		lastError = fmt.Sprintf("%q", *q.LastError)
+	}
+	return fmt.Sprintf("QueuedMail{\n\tId: %d\n\tFrom: %q\n\tRcpt: %q\n\tState: %s\n\tAttempts: %d\n\tLastError: %s\n}\n",
+		q.Id, q.From, q.Rcpt, q.State, q.Attempts, lastError)
+}
+
+// Store a received mail (From, Rcpt, Raw and the SMTP client). Returns the id
+// of the queued mail.
+func (db DB) Enqueue(mail QueuedMail) (int64, error) {
+	now := time.Now().Unix()
+	res, err := db.Exec(`
+	INSERT INTO inbox (mailFrom, rcpt, clientIp, helo, raw, receivedAt, nextAttemptAt, attempts, state)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)`,
+		mail.From, mail.Rcpt, mail.ClientIp, mail.Helo, mail.Raw, now, now, QueueWaiting)
+	if err != nil {
+		return 0, fmt.Errorf("Error queueing mail: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("Error getting queued mail id: %w", err)
+	}
+	return id, nil
+}
+
+// Put mails which were being processed when the tooltracker stopped back in
+// the queue. Their transaction will have been rolled back.
+func (db DB) RequeueProcessing() error {
+	_, err := db.Exec(`UPDATE inbox SET state = ? WHERE state = ?`,
+		QueueWaiting, QueueProcessing)
+	if err != nil {
+		return fmt.Errorf("Error requeueing mails: %w", err)
+	}
+	return nil
+}
+
+// Take the oldest mail which is due, for processing. Returns nil if there
+// isn't one.
+func (db DB) ClaimQueued(now time.Time) (*QueuedMail, error) {
+	for {
+		var id int64
+		err := db.QueryRow(`
+		SELECT id FROM inbox WHERE state = ? AND nextAttemptAt <= ?
+			ORDER BY id LIMIT 1`,
+			QueueWaiting, now.Unix()).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Error finding queued mail: %w", err)
+		}
+
+		queued, err := db.ClaimQueuedId(id)
+		if queued == nil && err == nil {
+			// Another worker got to it first
+			continue
+		}
+		return queued, err
+	}
+}
+
+// Take the given mail for processing. Returns nil if it isn't waiting, e.g.
+// another worker got to it first.
+func (db DB) ClaimQueuedId(id int64) (*QueuedMail, error) {
+	res, err := db.Exec(`
+	UPDATE inbox SET state = ?, attempts = attempts + 1
+		WHERE id = ? AND state = ?`,
+		QueueProcessing, id, QueueWaiting)
+	if err != nil {
+		return nil, fmt.Errorf("Error claiming queued mail: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, nil
+	}
+	return db.GetQueued(id)
+}
+
+func (db DB) GetQueued(id int64) (*QueuedMail, error) {
+	var q QueuedMail
+	var receivedAt int64
+	err := db.QueryRow(`
+	SELECT id, mailFrom, rcpt, coalesce(clientIp, ''), coalesce(helo, ''), raw, receivedAt, attempts, lastError, verification, state
+		FROM inbox WHERE id = ?`, id).Scan(
+		&q.Id, &q.From, &q.Rcpt, &q.ClientIp, &q.Helo, &q.Raw, &receivedAt, &q.Attempts, &q.LastError, &q.Verification, &q.State)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting queued mail: %w", err)
+	}
+	q.ReceivedAt = time.Unix(receivedAt, 0)
+	return &q, nil
+}
+
+// Mails in the given states, oldest first, without the raw mail
+func (db DB) GetQueue(states ...QueueState) []QueuedMail {
+	if len(states) == 0 {
+		return nil
+	}
+	args := make([]any, len(states))
+	for i, state := range states {
+		args[i] = state
+	}
+	rows, err := db.Query(`
+	SELECT id, mailFrom, rcpt, receivedAt, attempts, lastError, verification, state
+		FROM inbox WHERE state IN (?`+strings.Repeat(", ?", len(states)-1)+`) ORDER BY id`,
+		args...)
+	if err != nil {
+		log.Printf("Error executing query: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var queue []QueuedMail
+	for rows.Next() {
+		var q QueuedMail
+		var receivedAt int64
+		err := rows.Scan(&q.Id, &q.From, &q.Rcpt, &receivedAt, &q.Attempts, &q.LastError, &q.Verification, &q.State)
+		if err != nil {
+			log.Printf("Error scanning row: %v", err)
+			return nil
+		}
+		q.ReceivedAt = time.Unix(receivedAt, 0)
+		queue = append(queue, q)
+	}
+	return queue
+}
+
+// Remove a processed mail from the queue
+func (db DB) FinishQueued(id int64) error {
+	_, err := db.Exec(`DELETE FROM inbox WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("Error removing queued mail: %w", err)
+	}
+	return nil
+}
+
+var ErrNotDiscardable = errors.New("Only quarantined or dead mails can be discarded")
+
+// Remove a quarantined or dead mail, not one which is waiting or being
+// processed
+func (db DB) DiscardQueued(id int64) error {
+	result, err := db.Exec(`DELETE FROM inbox WHERE id = ? AND state IN (?, ?)`,
+		id, QueueQuarantined, QueueDead)
+	if err != nil {
+		return fmt.Errorf("Error discarding queued mail: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotDiscardable
+	}
+	return nil
+}
+
+// Try a failed mail again at the given time
+func (db DB) RetryQueued(id int64, reason string, at time.Time) error {
+	_, err := db.Exec(`
+	UPDATE inbox SET state = ?, lastError = ?, nextAttemptAt = ? WHERE id = ?`,
+		QueueWaiting, reason, at.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("Error rescheduling queued mail: %w", err)
+	}
+	return nil
+}
+
+// Give up on a mail, it stays in the database for an admin to look at
+func (db DB) DeadLetter(id int64, reason string) error {
+	_, err := db.Exec(`UPDATE inbox SET state = ?, lastError = ? WHERE id = ?`,
+		QueueDead, reason, id)
+	if err != nil {
+		return fmt.Errorf("Error dead-lettering queued mail: %w", err)
+	}
+	return nil
+}
+
+// Keep a rejected mail for an admin to look at, see RequeueMail
+func (db DB) Quarantine(id int64, reason, verification string) error {
+	_, err := db.Exec(`DELETE FROM inbox WHERE state = ? AND receivedAt < ?`,
+		QueueQuarantined, time.Now().Add(-quarantineRetention).Unix())
+	if err != nil {
+		return fmt.Errorf("Error pruning quarantined mails: %w", err)
+	}
+	_, err = db.Exec(`
+	UPDATE inbox SET state = ?, lastError = ?, verification = ? WHERE id = ?`,
+		QueueQuarantined, reason, verification, id)
+	if err != nil {
+		return fmt.Errorf("Error quarantining mail: %w", err)
+	}
+	return nil
+}
+
+// Process a quarantined or dead mail again, e.g. after fixing the
+// configuration
+func (db DB) RequeueMail(id int64) error {
+	_, err := db.Exec(`
+	UPDATE inbox SET state = ?, attempts = 0, nextAttemptAt = ?
+		WHERE id = ? AND state != ?`,
+		QueueWaiting, time.Now().Unix(), id, QueueProcessing)
+	if err != nil {
+		return fmt.Errorf("Error requeueing mail: %w", err)
+	}
+	return nil
+}
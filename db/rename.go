@@ -0,0 +1,164 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/KoviRobi/tooltracker/toolname"
+)
+
+// Tools can be renamed, or merged into another tool (e.g. a duplicate made by
+// a typo). The old name (and the old ID of a merged tool) is kept as an alias,
+// so that printed QR codes keep working, see mail.Session.resolveTool.
+
+var ErrNoSuchTool = errors.New("No such tool")
+
+type ToolAlias struct {
+	// The old name, or ID
+	Alias string
+	// ID of the tool
+	Tool string
+}
+
+func (a ToolAlias) String() string {
+	return fmt.Sprintf("ToolAlias{\n\tAlias: %q\n\tTool: %q\n}\n", a.Alias, a.Tool)
+}
+
+// Rename the tool with the ID, merging it into the other tool if there is one
+// with that name already: the more recent location is kept, the tags are
+// combined, and the merged tool's description, image and language are only
+// used where the other tool doesn't have one. Pending handovers and aliases
+// move to the other tool. Returns the ID the tool has now.
+func (db DB) RenameTool(id, to string) (string, error) {
+	to = strings.TrimSpace(to)
+	if toolname.Canonical(to) == "" {
+		return id, ErrNoName
+	}
+	tool := db.GetTool(id)
+	if tool.Id == "" {
+		return id, fmt.Errorf("%w %q", ErrNoSuchTool, id)
+	}
+	if tool.Name == to {
+		return tool.Id, nil
+	}
+
+	into := db.GetToolByName(to).Id
+	if into == "" || into == tool.Id {
+		return tool.Id, db.Transaction(func(tx DB) error {
+			return tx.execAll([]query{
+				{`UPDATE tool SET name = ? WHERE id = ?`, []any{to, tool.Id}},
+				{`DELETE FROM toolAliases WHERE alias = ?`, []any{to}},
+				{`INSERT INTO toolAliases (alias, tool) VALUES (?, ?)
+					ON CONFLICT(alias) DO UPDATE SET tool = excluded.tool`, []any{tool.Name, tool.Id}},
+			})
+		})
+	}
+
+	return into, db.Transaction(func(tx DB) error {
+		from := tool.Id
+		return tx.execAll([]query{
+			// Keep the more recent location, the target's if in doubt
+			{`DELETE FROM tracker WHERE tool = ?
+				AND coalesce(lastSeenAt, 0) < (SELECT coalesce(lastSeenAt, 0) FROM tracker WHERE tool = ?)`, []any{into, from}},
+			{`DELETE FROM tracker WHERE tool = ?
+				AND EXISTS (SELECT 1 FROM tracker WHERE tool = ?)`, []any{from, into}},
+			{`UPDATE tracker SET tool = ? WHERE tool = ?`, []any{into, from}},
+
+			{`UPDATE tool SET
+				description = coalesce(description, (SELECT description FROM tool WHERE id = ?)),
+				image = CASE WHEN image IS NULL OR image = ''
+					THEN (SELECT image FROM tool WHERE id = ?) ELSE image END,
+				language = coalesce(language, (SELECT language FROM tool WHERE id = ?))
+				WHERE id = ?`, []any{from, from, from, into}},
+			{`DELETE FROM tool WHERE id = ?`, []any{from}},
+
+			{`INSERT INTO tags (tag, tool) SELECT tag, ? FROM tags WHERE tool = ?
+				ON CONFLICT DO NOTHING`, []any{into, from}},
+			{`DELETE FROM tags WHERE tool = ?`, []any{from}},
+
+			{`UPDATE handovers SET tool = ? WHERE tool = ?`, []any{into, from}},
+
+			{`UPDATE toolAliases SET tool = ? WHERE tool = ?`, []any{into, from}},
+			{`INSERT INTO toolAliases (alias, tool) VALUES (?, ?), (?, ?)
+				ON CONFLICT(alias) DO UPDATE SET tool = excluded.tool`, []any{tool.Name, into, from, into}},
+		})
+	})
+}
+
+// Positional arguments, not all drivers support named ones
+type query struct {
+	sql  string
+	args []any
+}
+
+func (db DB) execAll(queries []query) error {
+	for _, query := range queries {
+		_, err := db.Exec(query.sql, query.args...)
+		if err != nil {
+			return fmt.Errorf("Error executing query: %w", err)
+		}
+	}
+	return nil
+}
+
+// The ID of the tool which the name refers to, as its ID, its current name or
+// an old name (e.g. a bookmark). Returns "" if none.
+func (db DB) FindTool(name string) string {
+	if tool := db.GetTool(name); tool.Id != "" {
+		return tool.Id
+	}
+	if tool := db.GetToolByName(name); tool.Id != "" {
+		return tool.Id
+	}
+	name = strings.TrimSpace(name)
+	for _, alias := range db.GetToolAliases() {
+		if alias.Alias == name {
+			return alias.Tool
+		}
+	}
+	return ""
+}
+
+// All the old names, by tool then alias
+func (db DB) GetToolAliases() []ToolAlias {
+	rows, err := db.Query(`SELECT alias, tool FROM toolAliases ORDER BY tool, alias`)
+	if err != nil {
+		log.Printf("Error executing query: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var aliases []ToolAlias
+	for rows.Next() {
+		var alias ToolAlias
+		err := rows.Scan(&alias.Alias, &alias.Tool)
+		if err != nil {
+			log.Printf("Error getting row from query: %v", err)
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases
+}
+
+// The old names (and IDs) of the tool with the ID
+func (db DB) GetAliasesOfTool(tool string) []string {
+	var names []string
+	for _, alias := range db.GetToolAliases() {
+		if alias.Tool == tool {
+			names = append(names, alias.Alias)
+		}
+	}
+	return names
+}
+
+// Stop the old name referring to its tool, e.g. to reuse it
+func (db DB) DeleteToolAlias(alias string) error {
+	_, err := db.Exec(`DELETE FROM toolAliases WHERE alias = ?`, strings.TrimSpace(alias))
+	if err != nil {
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/KoviRobi/tooltracker/toolname"
+)
+
+// Tools are keyed by a short random ID, which goes in the QR codes and URLs,
+// so that the name is just for display and can be changed (see RenameTool),
+// and can have characters which mail clients would mangle.
+
+var ErrNoName = errors.New("Missing tool name, or only punctuation")
+
+// Lower case, and no padding, so it can be typed and put in a local part
+var toolIdEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").
+	WithPadding(base32.NoPadding)
+
+// A new random tool ID, e.g. "k3x9q2ab"
+func NewToolId() string {
+	id := make([]byte, 5)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to generate tool ID: %v", err))
+	}
+	return toolIdEncoding.EncodeToString(id)
+}
+
+// Add a tool with a new ID. If the name was the old name of another tool (see
+// RenameTool), it now refers to the new tool.
+func (db DB) AddTool(name string) (Tool, error) {
+	tool := Tool{Id: NewToolId(), Name: strings.TrimSpace(name)}
+	// E.g. "--", which couldn't be told apart from other such names
+	if toolname.Canonical(tool.Name) == "" {
+		return tool, ErrNoName
+	}
+	err := db.Transaction(func(tx DB) error {
+		_, err := tx.Exec(`INSERT INTO tool (id, name, image) VALUES (?, ?, '')`, tool.Id, tool.Name)
+		if err != nil {
+			return fmt.Errorf("Error executing query: %w", err)
+		}
+		return tx.DeleteToolAlias(tool.Name)
+	})
+	return tool, err
+}
+
+// Mark the tool as added by an admin, so its QR codes carry a token (see
+// mail.QrToken)
+func (db DB) RegisterTool(id string) error {
+	res, err := db.Exec(`UPDATE tool SET registered = 1 WHERE id = ?`, strings.TrimSpace(id))
+	if err != nil {
+		return fmt.Errorf("Error executing query: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w %q", ErrNoSuchTool, id)
+	}
+	return nil
+}
+
+// Tooltrackers before tool IDs keyed everything on the name, give each of
+// those tools an ID
+func (db DB) migrateToolIds() error {
+	_, err := db.Exec(`SELECT id FROM tool LIMIT 0`)
+	if err == nil {
+		return nil
+	}
+	log.Printf("Adding IDs to tools")
+
+	return db.Transaction(func(tx DB) error {
+		_, err := tx.Exec(`ALTER TABLE tool RENAME TO toolByName`)
+		if err != nil {
+			return fmt.Errorf("Error renaming old tool table: %w", err)
+		}
+		_, err = tx.Exec(`CREATE TABLE tool (id TEXT PRIMARY KEY, name TEXT NOT NULL UNIQUE, description text, image TEXT, language TEXT)`)
+		if err != nil {
+			return fmt.Errorf("Error creating tool table: %w", err)
+		}
+
+		rows, err := tx.Query(`
+		SELECT name FROM toolByName
+			UNION SELECT tool FROM tracker
+			UNION SELECT tool FROM tags
+			UNION SELECT tool FROM handovers
+			UNION SELECT tool FROM toolAliases`)
+		if err != nil {
+			return fmt.Errorf("Error executing query: %w", err)
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			err = rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("Error getting row from query: %w", err)
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+
+		for _, name := range names {
+			_, err = tx.Exec(`INSERT INTO tool (id, name) VALUES (?, ?)`, NewToolId(), name)
+			if err != nil {
+				return fmt.Errorf("Error executing query: %w", err)
+			}
+		}
+
+		for _, query := range []string{
+			`UPDATE tool SET
+				description = (SELECT description FROM toolByName WHERE toolByName.name = tool.name),
+				image = coalesce((SELECT image FROM toolByName WHERE toolByName.name = tool.name), ''),
+				language = (SELECT language FROM toolByName WHERE toolByName.name = tool.name)`,
+			`UPDATE tracker SET tool = (SELECT id FROM tool WHERE name = tracker.tool)`,
+			`UPDATE tags SET tool = (SELECT id FROM tool WHERE name = tags.tool)`,
+			`UPDATE handovers SET tool = (SELECT id FROM tool WHERE name = handovers.tool)`,
+			`UPDATE toolAliases SET tool = (SELECT id FROM tool WHERE name = toolAliases.tool)`,
+			`DROP TABLE toolByName`,
+		} {
+			_, err = tx.Exec(query)
+			if err != nil {
+				return fmt.Errorf("Error executing query: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -16,7 +16,7 @@ buildGoModule {
 
   tags = lib.optional withODBC "odbc";
 
-  vendorHash = "sha256-niqK7St2gz+VeJFEnNF+uhNE4b5W0pZ/m4YObXeO3DA=";
+  vendorHash = "sha256-HGIF4J3ZRKV4REvrgceEWIZb0DWCbbJPAhBFw+VQ+pQ=";
 
   subPackages = [ "cmd/tooltracker" ];
 
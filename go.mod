@@ -3,6 +3,8 @@ module github.com/KoviRobi/tooltracker
 go 1.22.5
 
 require (
+	blitiri.com.ar/go/spf v1.5.1
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/alexbrainman/odbc v0.0.0-20241104074637-25af894ea08b
 	github.com/earthboundkid/versioninfo/v2 v2.24.1
 	github.com/emersion/go-imap/v2 v2.0.0-beta.4.0.20250106081522-9115cb9a2acb
@@ -12,15 +14,20 @@ require (
 	github.com/k3a/html2text v1.2.1
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/mcnijman/go-emailaddress v1.1.1
+	github.com/miekg/dns v1.1.62
 	github.com/mnako/letters v0.2.3
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/spf13/cobra v1.8.1
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.19.0
-	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d
+	go.mozilla.org/pkcs7 v0.9.0
+	golang.org/x/net v0.30.0
+	golang.org/x/text v0.19.0
+	golang.org/x/tools v0.22.0
 )
 
 require (
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/emersion/go-message v0.18.1 // indirect
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
@@ -38,11 +45,9 @@ require (
 	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9 // indirect
-	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.30.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
-	golang.org/x/text v0.19.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,7 +1,9 @@
 // This module listens on an IMAP connection, initially reading all mail in the
 // given folder, then starting an IDLE connection, and reading new mail.
-// Whenever it has processed an email (successfully or failed due to some
-// parsing error), it deletes it.
+// Whenever it has processed an email (see mail.Queue), it moves it to the
+// processed or failed folder, or deletes it. The UID of the last mail processed
+// is kept in the database, so that after reconnecting only new mail is
+// fetched, even if some mail was kept in the folder.
 package imap
 
 import (
@@ -24,17 +26,33 @@ import (
 
 type Session struct {
 	Db           db.DB
+	Queue        *mail.Queue
 	ShutdownChan chan struct{}
-	Dkim         string
 	Host         string
 	User         string
 	Mailbox      string
-	TokenCmd     []string
-	IdlePoll     time.Duration
-	Delegate     bool
-	LocalDkim    bool
+	// Where mail goes once it has been processed (or queued for a retry), and
+	// mail which was rejected or couldn't be parsed, so there is an audit
+	// trail. Empty to delete the mail instead.
+	ProcessedMailbox string
+	FailedMailbox    string
+	TokenCmd         []string
+	IdlePoll         time.Duration
+
+	// Where we got up to in the selected mailbox
+	state db.ImapState
 }
 
+// What to do with a message once it has been handled, see forwardMessage
+type disposition int
+
+const (
+	// Leave it in the mailbox, to try again next time
+	keep disposition = iota
+	processed
+	failed
+)
+
 func (s *Session) Listen() error {
 	var err error
 
@@ -76,12 +94,20 @@ authenticate:
 			return fmt.Errorf("Failed to select mailbox %s: %w", s.Mailbox, err)
 		}
 		log.Printf("Mailbox %s contains %v messages", s.Mailbox, selectedMbox.NumMessages)
+		s.loadState(selectedMbox.UIDValidity)
+		for _, mailbox := range []string{s.ProcessedMailbox, s.FailedMailbox} {
+			err = ensureMailbox(c, mailbox)
+			if err != nil {
+				log.Printf("Failed to create mailbox %s: %v", mailbox, err)
+				return fmt.Errorf("Failed to create mailbox %s: %w", mailbox, err)
+			}
+		}
 		numMessages := selectedMbox.NumMessages
 
 	idleLoop:
 		for {
 			if numMessages > 0 {
-				s.fetchMessages(numMessages, c)
+				s.fetchMessages(c)
 			}
 
 			select {
@@ -167,94 +193,176 @@ func (s *Session) authenticate(c *imapclient.Client) error {
 	return nil
 }
 
-// Fetch from IMAP and forward messages to the tooltracker mail handler
-func (s *Session) fetchMessages(numMessages uint32, c *imapclient.Client) {
-	var next uint32 = 0
-	for next < numMessages {
+// Create the mailbox if it doesn't exist yet, nothing to do for ""
+func ensureMailbox(c *imapclient.Client, mailbox string) error {
+	if mailbox == "" {
+		return nil
+	}
+	mailboxes, err := c.List("", mailbox, nil).Collect()
+	if err != nil {
+		return err
+	}
+	if len(mailboxes) > 0 {
+		return nil
+	}
+	log.Printf("Creating mailbox %q", mailbox)
+	return c.Create(mailbox, nil).Wait()
+}
+
+// Where we got up to in the mailbox last time. If the UIDVALIDITY changed
+// (e.g. the mailbox was recreated) the UIDs have been reassigned, so start from
+// the beginning; mail which was already processed is ignored, see
+// db.MarkProcessed.
+func (s *Session) loadState(uidValidity uint32) {
+	s.state = s.Db.GetImapState(fmt.Sprintf("%s@%s/%s", s.User, s.Host, s.Mailbox))
+	if s.state.UidValidity != uidValidity {
+		if s.state.UidValidity != 0 {
+			log.Printf("UIDVALIDITY of %s changed from %d to %d, fetching all mail",
+				s.Mailbox, s.state.UidValidity, uidValidity)
+		}
+		s.state.UidValidity = uidValidity
+		s.state.LastUid = 0
+	}
+	log.Printf("Fetching from UID %d", s.state.LastUid+1)
+}
+
+// Fetch new mail from IMAP, i.e. after the last one processed, and forward the
+// messages to the tooltracker mail handler
+func (s *Session) fetchMessages(c *imapclient.Client) {
+	// Moved (or deleted) at the end, so as not to interrupt the fetch
+	var processedUids, failedUids imap.UIDSet
+	lastUid := imap.UID(s.state.LastUid)
+	// Once a message is kept, don't go past it, so that it is retried next time
+	advance := true
+
+	bodySection := &imap.FetchItemBodySection{
+		Partial: &imap.SectionPartial{Offset: 0, Size: int64(limits.MaxMessageBytes)},
+	}
+	fetchOptions := &imap.FetchOptions{
+		UID:         true,
+		Envelope:    true,
+		BodySection: []*imap.FetchItemBodySection{bodySection},
+	}
+	// Stop 0 is "*", the last message
+	uidSet := imap.UIDSet{imap.UIDRange{Start: lastUid + 1, Stop: 0}}
+	log.Printf("Fetching UIDs %v", uidSet)
+	fetchCmd := c.Fetch(uidSet, fetchOptions)
+fetch:
+	for {
 		select {
 		case <-s.ShutdownChan:
 			log.Printf("Shutting down")
-			return
+			break fetch
 		default:
 		}
 
-		// IMAP uses 1-based numbering so increment here
-		next = next + 1
-		log.Printf("Fetching seq-num %d", next)
-		seqSet := imap.SeqSetNum(next)
-		bodySection := &imap.FetchItemBodySection{
-			Partial: &imap.SectionPartial{Offset: 0, Size: int64(limits.MaxMessageBytes)},
+		msg := fetchCmd.Next()
+		if msg == nil {
+			break
+		}
+		message, err := msg.Collect()
+		if err != nil {
+			log.Printf("Failed to fetch message in %s: %v", s.Mailbox, err)
+			advance = false
+			continue
 		}
-		fetchOptions := &imap.FetchOptions{
-			Envelope:    true,
-			BodySection: []*imap.FetchItemBodySection{bodySection},
+		// "n:*" includes the last message even if its UID is less than n
+		if message.UID <= lastUid {
+			continue
 		}
-		messages, err := c.Fetch(seqSet, fetchOptions).Collect()
 
-		if err != nil {
-			log.Printf("Failed to fetch message %d in %s: %v", next, s.Mailbox, err)
-		} else if len(messages) == 0 {
-			log.Printf("Fetched zero messages")
-		} else {
-			for _, message := range messages {
-				s.forwardMessage(message, c)
-			}
+		switch s.forwardMessage(message) {
+		case processed:
+			processedUids.AddNum(message.UID)
+		case failed:
+			failedUids.AddNum(message.UID)
+		case keep:
+			advance = false
+		}
+		if advance {
+			s.state.LastUid = uint32(message.UID)
 		}
 	}
-	_, err := c.Expunge().Collect()
+	err := fetchCmd.Close()
 	if err != nil {
-		log.Printf("Failed to expunge messages: %v", err)
+		log.Printf("Failed to fetch messages %v in %s: %v", uidSet, s.Mailbox, err)
+	}
+
+	s.finish(c, processedUids, s.ProcessedMailbox)
+	s.finish(c, failedUids, s.FailedMailbox)
+
+	if imap.UID(s.state.LastUid) != lastUid {
+		err = s.Db.UpdateImapState(s.state)
+		if err != nil {
+			log.Printf("Failed to save IMAP state: %v", err)
+		}
 	}
 }
 
-// Forward a message to the tooltracker mail handler
-func (s *Session) forwardMessage(
-	message *imapclient.FetchMessageBuffer,
-	c *imapclient.Client,
-) {
+// Process a message with the tooltracker mail handler. Mail which can't be
+// queued (e.g. the database is unavailable) is kept, so that it isn't lost;
+// mail which fails later is queued for a retry, see mail.Queue.
+func (s *Session) forwardMessage(message *imapclient.FetchMessageBuffer) disposition {
 	if len(message.Envelope.From) != 1 {
 		log.Printf("Expecting one from address, got %d", len(message.Envelope.From))
+		return failed
 	} else if len(message.BodySection) != 1 {
 		log.Printf("Expecting one body but got %d", len(message.BodySection))
-	} else {
-		from := message.Envelope.From[0].Addr()
-		var body []byte
-		for _, body = range message.BodySection {
-			break
-		}
-		session := mail.Session{
-			Db:        s.Db,
-			Dkim:      s.Dkim,
-			Delegate:  s.Delegate,
-			LocalDkim: s.LocalDkim,
-			From:      &from,
+		return failed
+	}
+
+	from := message.Envelope.From[0].Addr()
+	var body []byte
+	for _, body = range message.BodySection {
+		break
+	}
+	log.Printf("Processing message from %s subject %s", from, message.Envelope.Subject)
+	outcome, err := s.Queue.Submit(db.QueuedMail{From: from, Raw: body})
+	if err != nil {
+		// Leave it in the mailbox for next time
+		return keep
+	}
+	// Rate limited mail is in the queue for a retry, like a database error
+	if outcome != nil && outcome.Quarantined() {
+		return failed
+	}
+	return processed
+}
+
+// Move the messages to the mailbox, or delete them if it is "". MOVE falls
+// back to COPY and deleting the messages if the server doesn't support it.
+func (s *Session) finish(c *imapclient.Client, uids imap.UIDSet, mailbox string) {
+	if len(uids) == 0 {
+		return
+	}
+
+	if mailbox != "" {
+		_, err := c.Move(uids, mailbox).Wait()
+		if err != nil {
+			log.Printf("Failed to move messages %v to %s: %v", uids, mailbox, err)
 		}
-		log.Printf("Processing message from %s subject %s", from, message.Envelope.Subject)
-		session.Handle(body)
+		return
 	}
+
 	storeFlags := imap.StoreFlags{
-		Op:    imap.StoreFlagsAdd,
-		Flags: []imap.Flag{imap.FlagDeleted},
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{imap.FlagDeleted},
 	}
-	msgs, err := c.Store(imap.SeqSetNum(message.SeqNum), &storeFlags, nil).Collect()
+	err := c.Store(uids, &storeFlags, nil).Close()
 	if err != nil {
-		log.Printf("Got error setting deleted on message: %v", err)
-	} else if len(msgs) != 1 {
-		log.Printf(
-			"Expected to delete 1 message, deleted %d -- is someone also operating on this mailbox?",
-			len(msgs),
-		)
-		for i, msg := range msgs {
-			decoration := "Unexpected"
-			if msg == nil {
-				log.Printf("Message %d is <nil> -- bug in imapclient?", i)
-			} else {
-				if msg.SeqNum == message.SeqNum {
-					decoration = "Expected"
-				}
-				log.Printf("%s message subject: %s", decoration, msg.Envelope.Subject)
-			}
-		}
+		log.Printf("Got error setting deleted on messages %v: %v", uids, err)
+		return
+	}
+	var expunge *imapclient.ExpungeCommand
+	if c.Caps().Has(imap.CapUIDPlus) {
+		expunge = c.UIDExpunge(uids)
+	} else {
+		expunge = c.Expunge()
+	}
+	_, err = expunge.Collect()
+	if err != nil {
+		log.Printf("Failed to expunge messages: %v", err)
 	}
 }
 
@@ -8,3 +8,6 @@ var MaxMessageBytes uint32
 var MaxRecipients uint32
 var WriteTimeout time.Duration
 var ReadTimeout time.Duration
+
+// Images are stored base64 encoded in the database, so keep them small
+const MaxImageBytes = 100 * 1024
@@ -0,0 +1,413 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// ARC (RFC 8617) lets intermediaries such as mailing lists or forwarding rules
+// vouch for the authentication results they saw, before they broke the DKIM
+// signature (e.g. by adding a footer). Only sealers in Session.ArcSealers are
+// trusted, and only if all the later sealers are too.
+
+// RFC 8617 section 4.2.1
+const maxArcInstances = 50
+
+var ErrArcStructure = errors.New("Bad ARC set structure")
+var ErrArcBodyHash = errors.New("ARC-Message-Signature body hash mismatch")
+var ErrArcRevoked = errors.New("ARC key revoked")
+
+type headerField struct {
+	// Lower case
+	name string
+	// Including the name, folding and the final CRLF
+	raw string
+}
+
+func (f headerField) value() string {
+	_, value, _ := strings.Cut(f.raw, ":")
+	return value
+}
+
+// One instance of ARC headers
+type arcSet struct {
+	aar  headerField
+	ams  headerField
+	seal headerField
+}
+
+var wspRe = regexp.MustCompile(`[ \t]+`)
+var foldingRe = regexp.MustCompile(`\r?\n`)
+var signatureTagRe = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+var aarInstanceRe = regexp.MustCompile(`^\s*i\s*=\s*(\d+)\s*;`)
+
+// Split into header fields and the body, with CRLF line endings
+func splitMessage(raw []byte) ([]headerField, string) {
+	text := strings.ReplaceAll(string(raw), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n", "\r\n")
+	header, body, _ := strings.Cut(text, "\r\n\r\n")
+
+	var fields []headerField
+	for _, line := range strings.SplitAfter(header+"\r\n", "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, headerField{
+			name: strings.ToLower(strings.TrimSpace(name)),
+			raw:  line,
+		})
+	}
+	return fields, body
+}
+
+// Parse "a=rsa-sha256; d=example.com; ..." as in DKIM signatures
+func parseTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(foldingRe.ReplaceAllString(value, ""), ";") {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	for _, key := range []string{"b", "bh"} {
+		tags[key] = strings.Join(strings.Fields(tags[key]), "")
+	}
+	return tags
+}
+
+func relaxedHeader(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	value = foldingRe.ReplaceAllString(value, "")
+	value = strings.Trim(wspRe.ReplaceAllString(value, " "), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+func canonicalHeader(raw string, relaxed bool) string {
+	if relaxed {
+		return relaxedHeader(raw)
+	}
+	return raw
+}
+
+func canonicalBody(body string, relaxed bool) string {
+	lines := strings.Split(body, "\r\n")
+	if relaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(wspRe.ReplaceAllString(line, " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return ""
+		}
+		return "\r\n"
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// The header field being signed is hashed with an empty signature and without
+// the final CRLF
+func withoutSignature(raw string, relaxed bool) string {
+	name, value, _ := strings.Cut(raw, ":")
+	value = signatureTagRe.ReplaceAllString(value, "$1$2")
+	return strings.TrimSuffix(canonicalHeader(name+":"+value, relaxed), "\r\n")
+}
+
+// Header and body canonicalization, from the c= tag
+func canonicalization(c string) (relaxedHeader, relaxedBody bool) {
+	header, body, _ := strings.Cut(c, "/")
+	return header == "relaxed", body == "relaxed"
+}
+
+// The body hash (bh=) for the ARC-Message-Signature tags
+func amsBodyHash(body string, tags map[string]string) ([]byte, error) {
+	_, relaxed := canonicalization(tags["c"])
+	canonical := canonicalBody(body, relaxed)
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("%w: bad l=%q", ErrArcStructure, l)
+		}
+		canonical = canonical[:min(length, len(canonical))]
+	}
+	hash := sha256.Sum256([]byte(canonical))
+	return hash[:], nil
+}
+
+// The hash signed by an ARC-Message-Signature
+func amsHash(fields []headerField, ams headerField, tags map[string]string) []byte {
+	relaxed, _ := canonicalization(tags["c"])
+	hash := sha256.New()
+	// Like DKIM, each name picks the next instance, from the bottom up
+	used := make(map[string]int)
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		seen := 0
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fields[i].name != name {
+				continue
+			}
+			if seen == used[name] {
+				io.WriteString(hash, canonicalHeader(fields[i].raw, relaxed))
+				break
+			}
+			seen++
+		}
+		used[name]++
+	}
+	io.WriteString(hash, withoutSignature(ams.raw, relaxed))
+	return hash.Sum(nil)
+}
+
+// The hash signed by the ARC-Seal of sets[i]
+func sealHash(sets []arcSet, i int) []byte {
+	hash := sha256.New()
+	for j := 0; j <= i; j++ {
+		io.WriteString(hash, relaxedHeader(sets[j].aar.raw))
+		io.WriteString(hash, relaxedHeader(sets[j].ams.raw))
+		if j < i {
+			io.WriteString(hash, relaxedHeader(sets[j].seal.raw))
+		} else {
+			io.WriteString(hash, withoutSignature(sets[j].seal.raw, true))
+		}
+	}
+	return hash.Sum(nil)
+}
+
+func lookupKey(domain, selector string) (crypto.PublicKey, error) {
+	txts, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+	tags := parseTags(strings.Join(txts, ""))
+	if tags["p"] == "" {
+		return nil, ErrArcRevoked
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["p"]), ""))
+	if err != nil {
+		return nil, err
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(der)
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Bad ed25519 key length %d", len(der))
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	return nil, fmt.Errorf("Unknown key type %q", tags["k"])
+}
+
+// Check the signature (b=) over the hash with the key from d= and s=
+func verifyArcSignature(tags map[string]string, hashed []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	key, err := lookupKey(tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return fmt.Errorf("Algorithm %q doesn't match RSA key", tags["a"])
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed, sig)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return fmt.Errorf("Algorithm %q doesn't match ed25519 key", tags["a"])
+		}
+		if !ed25519.Verify(key, hashed, sig) {
+			return errors.New("ed25519 verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported key %T", key)
+}
+
+// The ARC sets, in instance order
+func arcSets(fields []headerField) ([]arcSet, error) {
+	var sets []arcSet
+	set := func(instance string) (*arcSet, error) {
+		i, err := strconv.Atoi(instance)
+		if err != nil || i < 1 || i > maxArcInstances {
+			return nil, fmt.Errorf("%w: bad instance %q", ErrArcStructure, instance)
+		}
+		for len(sets) < i {
+			sets = append(sets, arcSet{})
+		}
+		return &sets[i-1], nil
+	}
+	for _, field := range fields {
+		var target *headerField
+		var instance string
+		switch field.name {
+		case "arc-authentication-results":
+			match := aarInstanceRe.FindStringSubmatch(field.value())
+			if match == nil {
+				return nil, fmt.Errorf("%w: no instance in %q", ErrArcStructure, field.raw)
+			}
+			instance = match[1]
+		case "arc-message-signature", "arc-seal":
+			instance = parseTags(field.value())["i"]
+		default:
+			continue
+		}
+		s, err := set(instance)
+		if err != nil {
+			return nil, err
+		}
+		switch field.name {
+		case "arc-authentication-results":
+			target = &s.aar
+		case "arc-message-signature":
+			target = &s.ams
+		case "arc-seal":
+			target = &s.seal
+		}
+		if target.raw != "" {
+			return nil, fmt.Errorf("%w: duplicate %s", ErrArcStructure, field.name)
+		}
+		*target = field
+	}
+	for i, s := range sets {
+		if s.aar.raw == "" || s.ams.raw == "" || s.seal.raw == "" {
+			return nil, fmt.Errorf("%w: incomplete set %d", ErrArcStructure, i+1)
+		}
+	}
+	return sets, nil
+}
+
+// Validate the ARC chain (RFC 8617 section 5.2). Returns "none", "pass" or
+// "fail", and the sets if it passed.
+func validateArc(fields []headerField, body string) (string, []arcSet) {
+	sets, err := arcSets(fields)
+	if err != nil {
+		log.Printf("ARC: %v", err)
+		return "fail", nil
+	}
+	if len(sets) == 0 {
+		return "none", nil
+	}
+
+	for i, set := range sets {
+		cv := parseTags(set.seal.value())["cv"]
+		if i == len(sets)-1 && cv == "fail" {
+			log.Printf("ARC: chain already failed at instance %d", i+1)
+			return "fail", nil
+		}
+		if i == 0 && cv != "none" || i > 0 && cv != "pass" {
+			log.Printf("ARC: %v: instance %d has cv=%s", ErrArcStructure, i+1, cv)
+			return "fail", nil
+		}
+	}
+
+	// Only the latest message signature needs to be valid
+	latest := sets[len(sets)-1].ams
+	tags := parseTags(latest.value())
+	bodyHash, err := amsBodyHash(body, tags)
+	if err != nil {
+		log.Printf("ARC: %v", err)
+		return "fail", nil
+	}
+	if base64.StdEncoding.EncodeToString(bodyHash) != tags["bh"] {
+		log.Printf("ARC: %v", ErrArcBodyHash)
+		return "fail", nil
+	}
+	if err := verifyArcSignature(tags, amsHash(fields, latest, tags)); err != nil {
+		log.Printf("ARC: message signature %d: %v", len(sets), err)
+		return "fail", nil
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		tags := parseTags(sets[i].seal.value())
+		if err := verifyArcSignature(tags, sealHash(sets, i)); err != nil {
+			log.Printf("ARC: seal %d: %v", i+1, err)
+			return "fail", nil
+		}
+	}
+	return "pass", sets
+}
+
+type arcResults struct {
+	sealer  string
+	results []authres.Result
+}
+
+// The results vouched for by trusted sealers, latest first. Only the sets
+// after the last untrusted one count, as the untrusted sealer could have
+// changed the mail (e.g. the subject) and then sealed it with a valid
+// signature of its own.
+func trustedArcResults(sets []arcSet, sealers []string) []arcResults {
+	var trusted []arcResults
+	for i := len(sets) - 1; i >= 0; i-- {
+		sealer := strings.ToLower(parseTags(sets[i].seal.value())["d"])
+		if !slices.Contains(sealers, sealer) {
+			if i < len(sets)-1 {
+				log.Printf("ARC: untrusted sealer %s before trusted ones", sealer)
+			}
+			return trusted
+		}
+		value := aarInstanceRe.ReplaceAllString(sets[i].aar.value(), "")
+		_, results, err := authres.Parse(foldingRe.ReplaceAllString(value, ""))
+		if err != nil {
+			log.Printf("ARC: error parsing results from %s: %v", sealer, err)
+		}
+		trusted = append(trusted, arcResults{sealer, results})
+	}
+	return trusted
+}
+
+// Check the ARC chain, and whether a trusted sealer saw the mail pass for the
+// domain
+func (s *Session) checkArc(reader io.Reader, domain string) bool {
+	var buf bytes.Buffer
+	buf.ReadFrom(reader)
+	fields, body := splitMessage(buf.Bytes())
+	var sets []arcSet
+	s.arc, sets = validateArc(fields, body)
+	if s.arc != "pass" {
+		return false
+	}
+	trusted := trustedArcResults(sets, s.ArcSealers)
+	if len(trusted) == 0 {
+		log.Printf("ARC: latest sealer isn't trusted")
+		return false
+	}
+	for _, t := range trusted {
+		if authResultsPass(t.results, domain) {
+			return true
+		}
+		log.Printf("ARC: %s didn't see a pass for %s", t.sealer, domain)
+	}
+	return false
+}
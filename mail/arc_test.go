@@ -0,0 +1,186 @@
+package mail
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KoviRobi/tooltracker/db"
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+func arcSign(t *testing.T, hashed []byte) string {
+	sig, err := rsa.SignPKCS1v15(rand.Reader, testPrivateKey, crypto.SHA256, hashed)
+	Assert(t, err)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// Add an ARC set as the sealer would, e.g. a mailing list which checked the
+// mail and got the results, after any sets already in the mail
+func arcSeal(t *testing.T, mail, sealer, results string) string {
+	mail = strings.ReplaceAll(strings.ReplaceAll(mail, "\r\n", "\n"), "\n", "\r\n")
+	fields, body := splitMessage([]byte(mail))
+	sets, err := arcSets(fields)
+	Assert(t, err)
+	instance := len(sets) + 1
+	cv := "pass"
+	if instance == 1 {
+		cv = "none"
+	}
+
+	aar := headerField{
+		name: "arc-authentication-results",
+		raw:  fmt.Sprintf("ARC-Authentication-Results: i=%d; %s\r\n", instance, results),
+	}
+
+	amsRaw := fmt.Sprintf("ARC-Message-Signature: i=%d; a=rsa-sha256; c=relaxed/relaxed;\r\n", instance) +
+		" d=" + sealer + "; s=arc; h=from:to:subject; bh=%s; b="
+	tags := parseTags(fmt.Sprintf(amsRaw, ""))
+	bodyHash, err := amsBodyHash(body, tags)
+	Assert(t, err)
+	amsRaw = fmt.Sprintf(amsRaw, base64.StdEncoding.EncodeToString(bodyHash))
+	ams := headerField{name: "arc-message-signature", raw: amsRaw + "\r\n"}
+	ams.raw = amsRaw + arcSign(t, amsHash(fields, ams, tags)) + "\r\n"
+
+	sealRaw := fmt.Sprintf("ARC-Seal: i=%d; a=rsa-sha256; cv=%s; d=%s; s=arc; b=", instance, cv, sealer)
+	sets = append(sets, arcSet{aar: aar, ams: ams, seal: headerField{name: "arc-seal", raw: sealRaw + "\r\n"}})
+	seal := &sets[len(sets)-1].seal
+	seal.raw = sealRaw + arcSign(t, sealHash(sets, len(sets)-1)) + "\r\n"
+
+	return seal.raw + ams.raw + aar.raw + mail
+}
+
+func TestArc(t *testing.T) {
+	useResolver(t, fakeResolver{
+		"arc._domainkey." + Domain3: {
+			"v=DKIM1; k=rsa; p=" +
+				base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(
+					&testPrivateKey.PublicKey)),
+		},
+	})
+
+	// E.g. the original DKIM signature broken by a footer added by the list
+	sealed := arcSeal(t, fmt.Sprintf(PlainTemplate, User1, To, Borrow+Tool1, ""),
+		Domain3, "mx."+Domain3+"; dkim=pass header.d="+Domain1)
+	otherDomain := arcSeal(t, fmt.Sprintf(PlainTemplate, User1, To, Borrow+Tool1, ""),
+		Domain3, "mx."+Domain3+"; dkim=pass header.d="+Domain2)
+
+	for _, test := range []struct {
+		name     string
+		mail     string
+		sealers  []string
+		arc      string
+		accepted bool
+	}{
+		{"trusted", sealed, []string{Domain3}, "pass", true},
+		{"untrusted", sealed, []string{Domain2}, "pass", false},
+		{"other domain", otherDomain, []string{Domain3}, "pass", false},
+		{"tampered body", sealed + "Return " + Tool1 + "\r\n", []string{Domain3}, "fail", false},
+		{"tampered header", strings.Replace(sealed, Borrow+Tool1, Borrow+Tool2, 1),
+			[]string{Domain3}, "fail", false},
+		{"no seal", fmt.Sprintf(PlainTemplate, User1, To, Borrow+Tool1, ""), []string{Domain3}, "none", false},
+		{"not checked", sealed, nil, "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, s := setup(t, Domain1, true, true)
+			defer conn.Close()
+			s.ArcSealers = test.sealers
+
+			s.From = &User1
+			outcome := s.Handle([]byte(test.mail))
+			if test.accepted {
+				Assert(t, outcome.Err)
+			} else if outcome.Err != ErrInvalid {
+				t.Fatalf("Expected %v, got %v", ErrInvalid, outcome.Err)
+			}
+			if outcome.Arc != test.arc {
+				t.Errorf("Expected ARC %q, got %q", test.arc, outcome.Arc)
+			}
+
+			var expected []db.Item
+			if test.accepted {
+				expected = []db.Item{{Location: db.Location{Tool: Tool1, LastSeenBy: User1}}}
+			}
+			AssertSlicesEqual(t, expected, itemsByName(conn))
+		})
+	}
+}
+
+// Sealed by a mailing list (which added a footer, breaking the DKIM signature)
+// and then by a forwarder, see testdata/arc. Generated by a separate ARC
+// implementation, to check the canonicalization against.
+func readArcFixture(t *testing.T) (string, fakeResolver) {
+	mail, err := os.ReadFile(filepath.Join("testdata", "arc", "multihop.eml"))
+	Assert(t, err)
+	dns, err := os.ReadFile(filepath.Join("testdata", "arc", "multihop.dns"))
+	Assert(t, err)
+	records := fakeResolver{}
+	for _, line := range strings.Split(strings.TrimSpace(string(dns)), "\n") {
+		name, value, _ := strings.Cut(line, " ")
+		records[name] = []string{value}
+	}
+	return string(mail), records
+}
+
+func TestArcMultiHop(t *testing.T) {
+	mail, records := readArcFixture(t)
+	records["arc._domainkey."+Domain3] = []string{
+		"v=DKIM1; k=rsa; p=" +
+			base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(
+				&testPrivateKey.PublicKey)),
+	}
+	useResolver(t, records)
+
+	const list = "lists.c.example.com"
+	const forwarder = "fwd.b.example.com"
+	tampered := strings.Replace(mail, Borrow+Tool1, Borrow+Tool2, 1)
+	// The attacker can't fix the earlier signatures, but can add a valid set of
+	// its own on top
+	resealed := arcSeal(t, tampered, Domain3, "mx."+Domain3+"; arc=pass")
+	// E.g. a trusted forwarder after the untrusted ones, which saw the
+	// original DKIM signature pass
+	forwarded := arcSeal(t, mail, Domain3, "mx."+Domain3+"; dkim=pass header.d="+Domain1)
+
+	for _, test := range []struct {
+		name     string
+		mail     string
+		sealers  []string
+		arc      string
+		accepted bool
+	}{
+		{"both trusted", mail, []string{list, forwarder}, "pass", true},
+		// The forwarder could have changed the mail
+		{"forwarder untrusted", mail, []string{list}, "pass", false},
+		// It couldn't verify the original DKIM signature
+		{"list untrusted", mail, []string{forwarder}, "pass", false},
+		{"tampered", tampered, []string{list, forwarder}, "fail", false},
+		{"resealed", resealed, []string{list, forwarder}, "pass", false},
+		{"resealed list trusted", resealed, []string{list}, "pass", false},
+		{"latest trusted", forwarded, []string{Domain3}, "pass", true},
+		{"latest untrusted", forwarded, []string{list, forwarder}, "pass", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, s := setup(t, Domain1, true, true)
+			defer conn.Close()
+			s.ArcSealers = test.sealers
+
+			s.From = &User1
+			outcome := s.Handle([]byte(test.mail))
+			if test.accepted {
+				Assert(t, outcome.Err)
+			} else if outcome.Err != ErrInvalid {
+				t.Fatalf("Expected %v, got %v", ErrInvalid, outcome.Err)
+			}
+			if outcome.Arc != test.arc {
+				t.Errorf("Expected ARC %q, got %q", test.arc, outcome.Arc)
+			}
+		})
+	}
+}
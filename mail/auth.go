@@ -0,0 +1,168 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	netmail "net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Ways of proving a mail is from the domain (--dkim, or the delegate's), see
+// Session.Accept
+type AuthMethod string
+
+const (
+	// A valid DKIM signature by the domain
+	AuthDkim AuthMethod = "dkim"
+	// The SMTP client is allowed to send mail for the MAIL FROM domain (SMTP
+	// only)
+	AuthSpf AuthMethod = "spf"
+	// DKIM or SPF aligned with the From header, as per the domain's DMARC
+	// record
+	AuthDmarc AuthMethod = "dmarc"
+)
+
+var ErrUnknownAuthMethod = errors.New("Unknown authentication method")
+
+func ParseAuthMethods(methods []string) ([]AuthMethod, error) {
+	var ret []AuthMethod
+	for _, method := range methods {
+		switch m := AuthMethod(strings.ToLower(strings.TrimSpace(method))); m {
+		case AuthDkim, AuthSpf, AuthDmarc:
+			ret = append(ret, m)
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrUnknownAuthMethod, method)
+		}
+	}
+	return ret, nil
+}
+
+// All DNS lookups (DKIM, SPF and DMARC) go through this, compatible with
+// *net.Resolver
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+var resolver Resolver = net.DefaultResolver
+
+func SetResolver(r Resolver) {
+	resolver = r
+}
+
+func lookupTXT(name string) ([]string, error) {
+	return resolver.LookupTXT(context.Background(), name)
+}
+
+// The methods accepted, DKIM only by default
+func (s *Session) accepts(method AuthMethod) bool {
+	if s.Accept == nil {
+		return method == AuthDkim
+	}
+	return slices.Contains(s.Accept, method)
+}
+
+// The part after the @, or the whole thing if there isn't one
+func domainOf(address string) string {
+	address = strings.Trim(strings.TrimSpace(address), "<>")
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// The domain of the From header, which DMARC protects
+func headerFromDomain(r io.Reader) string {
+	header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		log.Printf("Error reading headers: %v", err)
+		return ""
+	}
+	// More than one From is not allowed by DMARC
+	if len(header.Values("From")) != 1 {
+		return ""
+	}
+	address, err := netmail.ParseAddress(header.Get("From"))
+	if err != nil {
+		log.Printf("Error parsing From header: %v", err)
+		return ""
+	}
+	return domainOf(address.Address)
+}
+
+// Is the SMTP client allowed to send for the MAIL FROM
+func (s *Session) checkSpf() spf.Result {
+	if s.ClientIp == nil {
+		// E.g. IMAP, the client isn't known
+		return spf.None
+	}
+	result, err := spf.CheckHostWithSender(s.ClientIp, s.Helo, *s.From,
+		spf.WithResolver(resolver))
+	if err != nil {
+		log.Printf("SPF check for %s from %s: %s, %v", *s.From, s.ClientIp, result, err)
+	}
+	return result
+}
+
+// The organizational domain, for relaxed alignment (RFC 7489 section 3.2)
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+func aligned(mode dmarc.AlignmentMode, a, b string) bool {
+	if mode == dmarc.AlignmentStrict {
+		return strings.EqualFold(a, b)
+	}
+	return strings.EqualFold(organizationalDomain(a), organizationalDomain(b))
+}
+
+// The DMARC record for the domain, or the organizational domain's
+func lookupDmarc(domain string) (*dmarc.Record, error) {
+	options := &dmarc.LookupOptions{LookupTXT: lookupTXT}
+	record, err := dmarc.LookupWithOptions(domain, options)
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		if org := organizationalDomain(domain); org != domain {
+			record, err = dmarc.LookupWithOptions(org, options)
+		}
+	}
+	return record, err
+}
+
+// Whether the From header's domain passes DMARC, given the domains with valid
+// DKIM signatures and the SPF result. Returns "pass", "fail" or "none" (no
+// DMARC record), as in Authentication-Results.
+func (s *Session) checkDmarc(fromDomain string, dkimDomains []string, spfResult spf.Result) string {
+	if fromDomain == "" {
+		return "none"
+	}
+	record, err := lookupDmarc(fromDomain)
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		return "none"
+	} else if err != nil {
+		log.Printf("DMARC lookup for %s: %v", fromDomain, err)
+		return "none"
+	}
+	for _, domain := range dkimDomains {
+		if aligned(record.DKIMAlignment, domain, fromDomain) {
+			return "pass"
+		}
+	}
+	if spfResult == spf.Pass && aligned(record.SPFAlignment, domainOf(*s.From), fromDomain) {
+		return "pass"
+	}
+	return "fail"
+}
@@ -0,0 +1,148 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/spf"
+
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+// Answers from a fixed set of TXT records, see SetResolver
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := f[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func useResolver(t *testing.T, records fakeResolver) {
+	old := resolver
+	SetResolver(records)
+	t.Cleanup(func() { SetResolver(old) })
+}
+
+const clientIp = "192.0.2.1"
+
+func TestSpf(t *testing.T) {
+	useResolver(t, fakeResolver{
+		Domain3: {"v=spf1 ip4:" + clientIp + " -all"},
+	})
+
+	for _, test := range []struct {
+		ip       string
+		accepted bool
+	}{
+		{clientIp, true},
+		{"192.0.2.2", false},
+	} {
+		conn, s := setup(t, Domain1, true, true)
+		defer conn.Close()
+		s.Accept = []AuthMethod{AuthSpf}
+		s.ClientIp = net.ParseIP(test.ip)
+
+		// User5 has no alias, so needs to be from Domain1
+		s.From = &User5
+		outcome := s.Handle(newPlain(User5, To, Borrow+Tool1, ""))
+		if outcome.Err != ErrInvalid {
+			t.Errorf("Expected %v for %s, got %v", ErrInvalid, test.ip, outcome.Err)
+		}
+		if outcome.Spf != spf.Pass && test.accepted || outcome.Spf == spf.Pass && !test.accepted {
+			t.Errorf("Unexpected SPF %s for %s", outcome.Spf, test.ip)
+		}
+	}
+}
+
+func TestSpfDelegate(t *testing.T) {
+	useResolver(t, fakeResolver{
+		Domain3: {"v=spf1 ip4:" + clientIp + " -all"},
+	})
+	conn, s := setup(t, Domain1, true, false)
+	defer conn.Close()
+	s.Accept = []AuthMethod{AuthSpf}
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Alias+User5, "")).Err)
+
+	// Delegates are checked against their own domain (and local-dkim is off
+	// for the Alias)
+	s.From = &User5
+	s.ClientIp = net.ParseIP(clientIp)
+	outcome := s.Handle(newPlain(User5, To, Borrow+Tool1, ""))
+	Assert(t, outcome.Err)
+	if outcome.Spf != spf.Pass {
+		t.Errorf("Expected SPF pass, got %s", outcome.Spf)
+	}
+}
+
+func TestDmarc(t *testing.T) {
+	useResolver(t, fakeResolver{
+		Domain3:              {"v=spf1 ip4:" + clientIp + " -all"},
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	})
+
+	for _, test := range []struct {
+		name     string
+		ip       string
+		accepted bool
+	}{
+		// SPF aligned with the organizational domain
+		{"spf", clientIp, true},
+		{"none", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, s := setup(t, Domain1, true, false)
+			defer conn.Close()
+			s.Accept = []AuthMethod{AuthDmarc}
+
+			s.From = &User1
+			Assert(t, s.Handle(newPlain(User1, To, Alias+User5, "")).Err)
+
+			s.From = &User5
+			s.ClientIp = net.ParseIP(test.ip)
+			outcome := s.Handle(newPlain(User5, To, Borrow+Tool1, ""))
+			if test.accepted {
+				Assert(t, outcome.Err)
+			} else if outcome.Err != ErrInvalid {
+				t.Fatalf("Expected %v, got %v", ErrInvalid, outcome.Err)
+			}
+		})
+	}
+}
+
+func TestDmarcDkim(t *testing.T) {
+	useResolver(t, fakeResolver{
+		"_dmarc." + Domain2: {"v=DMARC1; p=reject; adkim=s"},
+	})
+	conn, s := setup(t, Domain1, true, false)
+	defer conn.Close()
+	s.Accept = []AuthMethod{AuthDmarc}
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Alias+User3, "")).Err)
+
+	s.From = &User3
+	msg, err := newSigned(Domain2, "valid", User3, To, Borrow+Tool1, "")
+	Assert(t, err)
+	outcome := s.Handle(msg)
+	Assert(t, outcome.Err)
+	if outcome.Dmarc != "pass" {
+		t.Errorf("Expected DMARC pass, got %q", outcome.Dmarc)
+	}
+}
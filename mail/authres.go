@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// When an upstream MTA (e.g. Exchange or Gmail, in IMAP mode) has already
+// authenticated the mail, its Authentication-Results header (RFC 8601) can be
+// used instead of checking DKIM again, which fails if the MTA has rewritten
+// the body. See Session.AuthservId.
+
+// The results stamped by the trusted MTA. Only the top-most header with its
+// authserv-id is used, as anything further down could have been added by the
+// sender.
+func trustedAuthResults(r io.Reader, authservId string) []authres.Result {
+	header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		log.Printf("Error reading headers: %v", err)
+		return nil
+	}
+	for _, value := range header.Values("Authentication-Results") {
+		id, results, err := authres.Parse(value)
+		if !strings.EqualFold(id, authservId) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error parsing Authentication-Results: %v", err)
+		}
+		return results
+	}
+	return nil
+}
+
+// Whether any of the results prove the mail is from the domain
+func authResultsPass(results []authres.Result, domain string) bool {
+	for _, result := range results {
+		switch r := result.(type) {
+		case *authres.DKIMResult:
+			if r.Value == authres.ResultPass && strings.EqualFold(r.Domain, domain) {
+				return true
+			}
+		case *authres.DMARCResult:
+			if r.Value == authres.ResultPass && strings.EqualFold(domainOf(r.From), domain) {
+				return true
+			}
+		case *authres.SPFResult:
+			if r.Value == authres.ResultPass && strings.EqualFold(domainOf(r.From), domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
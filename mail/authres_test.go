@@ -0,0 +1,55 @@
+package mail
+
+import (
+	"testing"
+
+	"github.com/KoviRobi/tooltracker/db"
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+const authservId = "mx.example.com"
+
+func withAuthResults(mail []byte, headers ...string) []byte {
+	var ret []byte
+	for _, header := range headers {
+		ret = append(ret, "Authentication-Results: "+header+"\n"...)
+	}
+	return append(ret, mail...)
+}
+
+func TestAuthResults(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		accepted bool
+	}{
+		{"dkim", []string{authservId + "; dkim=pass header.d=" + Domain1}, true},
+		{"dmarc", []string{authservId + "; dmarc=pass header.from=" + Domain1}, true},
+		{"spf", []string{authservId + "; spf=pass smtp.mailfrom=" + User1}, true},
+		{"fail", []string{authservId + "; dkim=fail header.d=" + Domain1}, false},
+		{"other domain", []string{authservId + "; dkim=pass header.d=" + Domain2}, false},
+		{"untrusted", []string{"mx.evil.com; dkim=pass header.d=" + Domain1}, false},
+		// Added by the sender, below the MTA's own
+		{"forged", []string{
+			authservId + "; dkim=none",
+			authservId + "; dkim=pass header.d=" + Domain1,
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, s := setup(t, Domain1, true, true)
+			defer conn.Close()
+			s.AuthservId = authservId
+
+			s.From = &User1
+			outcome := s.Handle(withAuthResults(newPlain(User1, To, Borrow+Tool1, ""), test.headers...))
+			if test.accepted {
+				Assert(t, outcome.Err)
+				expected := []db.Item{{Location: db.Location{Tool: Tool1, LastSeenBy: User1}}}
+				AssertSlicesEqual(t, expected, itemsByName(conn))
+			} else if outcome.Err != ErrInvalid {
+				t.Fatalf("Expected %v, got %v", ErrInvalid, outcome.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package mail
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/k3a/html2text"
+	"github.com/mnako/letters"
+	"golang.org/x/net/html"
+)
+
+// Extracts what the user wrote in the mail, without the quoted mail they are
+// replying to, signatures, or "Sent from my phone" footers
+
+// Fix up divs to contain an extra new-line -- simple work-around to signatures
+// being separated by `</div>` and `<br>`
+var htmlNewlineTags = regexp.MustCompile(`</\s*div>`)
+
+// Lines starting the quoted mail, which is then ignored along with everything
+// after it
+var quoteHeaderRes = []*regexp.Regexp{
+	// Gmail, Thunderbird, Apple Mail, ...
+	regexp.MustCompile(`^(?i)On\b.*\bwrote:$`),
+	regexp.MustCompile(`^(?i)Am\b.*\bschrieb.*:$`),
+	regexp.MustCompile(`^(?i)Le\b.*\ba écrit\s*:$`),
+	// Outlook
+	regexp.MustCompile(`^(?i)-+\s*Original Message\s*-+$`),
+	regexp.MustCompile(`^(?i)-+\s*Forwarded message\s*-+$`),
+	regexp.MustCompile(`^_{10,}$`),
+}
+
+// Outlook quotes with a header block such as
+//
+//	From: Bob <bob@example.com>
+//	Sent: Monday, 1 January 2024 10:00
+var outlookFromRe = regexp.MustCompile(`^(?i)\*?(From|Von|De|Feladó)\s*:\*?\s`)
+var outlookSentRe = regexp.MustCompile(`^(?i)\*?(Sent|Date|Gesendet|Envoyé|Elküldve)\s*:\*?\s`)
+
+// Lines after the From: which can still be part of the Outlook header block
+const outlookHeaderLines = 3
+
+// Mobile mail clients' footers
+var footerRes = []*regexp.Regexp{
+	regexp.MustCompile(`^(?i)Sent from my\b`),
+	regexp.MustCompile(`^(?i)Sent from (Mail|Yahoo Mail|Outlook)\b`),
+	regexp.MustCompile(`^(?i)Get Outlook for\b`),
+	regexp.MustCompile(`^(?i)Von meinem .* gesendet$`),
+	regexp.MustCompile(`^(?i)Envoyé de mon\b`),
+}
+
+// RFC 3676 section 4.3, though some clients drop the trailing space
+var signatureDelimiterRe = regexp.MustCompile(`^--\s?$`)
+
+// HTML elements which contain the quoted mail (or the signature)
+func isQuoteNode(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if n.Data == "blockquote" {
+		return true
+	}
+	for _, attr := range n.Attr {
+		switch attr.Key {
+		case "class":
+			for _, class := range strings.Fields(attr.Val) {
+				switch class {
+				case "gmail_quote", "gmail_signature", "moz-cite-prefix", "moz-signature":
+					return true
+				}
+			}
+		case "id":
+			switch attr.Val {
+			case "divRplyFwdMsg", "appendonsend", "Signature":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Outlook puts the reply header and the quoted mail after divRplyFwdMsg (or
+// appendonsend), rather than inside it
+func isQuoteStartNode(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	for _, attr := range n.Attr {
+		if attr.Key == "id" && (attr.Val == "divRplyFwdMsg" || attr.Val == "appendonsend") {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the quoted parts from the HTML. Returns true once everything after
+// should be removed too.
+func removeQuotes(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if isQuoteStartNode(c) {
+			for ; c != nil; c = next {
+				next = c.NextSibling
+				n.RemoveChild(c)
+			}
+			return true
+		}
+		if isQuoteNode(c) {
+			n.RemoveChild(c)
+		} else if removeQuotes(c) {
+			for c = next; c != nil; c = next {
+				next = c.NextSibling
+				n.RemoveChild(c)
+			}
+			return true
+		}
+		c = next
+	}
+	return false
+}
+
+func htmlToText(htmlBody string) string {
+	doc, err := html.Parse(strings.NewReader(htmlBody))
+	if err == nil {
+		removeQuotes(doc)
+		var buf bytes.Buffer
+		if html.Render(&buf, doc) == nil {
+			htmlBody = buf.String()
+		}
+	}
+	htmlBody = htmlNewlineTags.ReplaceAllString(htmlBody, `$1<br>`)
+	// Indentation is just from the HTML source
+	lines := strings.Split(html2text.HTML2Text(htmlBody), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func matchesAny(res []*regexp.Regexp, line string) bool {
+	for _, re := range res {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is this the start of an Outlook header block
+func isOutlookHeader(lines []string) bool {
+	if !outlookFromRe.MatchString(lines[0]) {
+		return false
+	}
+	for _, line := range lines[1:min(len(lines), outlookHeaderLines+1)] {
+		if outlookSentRe.MatchString(strings.TrimSpace(line)) {
+			return true
+		}
+	}
+	return false
+}
+
+// The text the user wrote, from plain text
+func extractText(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+
+	var kept []string
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if signatureDelimiterRe.MatchString(line) ||
+			matchesAny(quoteHeaderRes, trimmed) ||
+			matchesAny(footerRes, trimmed) ||
+			isOutlookHeader(lines[i:]) {
+			break
+		}
+		// "On ... <bob@example.com>\nwrote:" when wrapped
+		if i+1 < len(lines) {
+			next := strings.TrimSpace(lines[i+1])
+			if !matchesAny(quoteHeaderRes, next) && matchesAny(quoteHeaderRes, trimmed+" "+next) {
+				break
+			}
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		kept = append(kept, strings.TrimRightFunc(line, unicode.IsSpace))
+	}
+
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+// The text the user wrote, preferring the plain text part
+func ExtractBody(m letters.Email) string {
+	text := m.Text
+	if strings.TrimSpace(text) == "" {
+		text = htmlToText(m.HTML)
+	}
+	if strings.TrimSpace(text) == "" {
+		// A wrapped message, e.g. S/MIME signing the headers too (RFC 8551
+		// section 3.1)
+		for _, file := range m.AttachedFiles {
+			if file.ContentType.ContentType != "message/rfc822" {
+				continue
+			}
+			if inner, err := letters.ParseEmail(bytes.NewReader(file.Data)); err == nil {
+				return ExtractBody(inner)
+			}
+		}
+	}
+	return extractText(stripPgpArmor(text))
+}
@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mnako/letters"
+)
+
+// Each testdata/bodies/<name>.eml has the expected body in <name>.txt
+func TestExtractBody(t *testing.T) {
+	emls, err := filepath.Glob(filepath.Join("testdata", "bodies", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emls == nil {
+		t.Fatal("No test e-mails found")
+	}
+
+	for _, eml := range emls {
+		t.Run(filepath.Base(eml), func(t *testing.T) {
+			f, err := os.Open(eml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			m, err := letters.ParseEmail(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := os.ReadFile(strings.TrimSuffix(eml, ".eml") + ".txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := ExtractBody(m)
+			if got != strings.TrimSpace(string(expected)) {
+				t.Fatalf("Expected:\n%s\nGot:\n%s", expected, got)
+			}
+		})
+	}
+}
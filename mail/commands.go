@@ -0,0 +1,301 @@
+package mail
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mnako/letters"
+)
+
+// What verification of the sender a command needs
+type DkimPolicy int
+
+const (
+	// The sender has to be verified as per --dkim (and delegation)
+	DkimRequired DkimPolicy = iota
+	// Anyone can use the command, it has to check the sender itself, e.g.
+	// Confirm alias
+	DkimNone
+)
+
+// What a command handler gets to work with
+type Request struct {
+	Mail *letters.Email
+	// Submatches of the command's matcher, so Args[0] is the whole match
+	Args []string
+	// Comment from the body, empty for lines of a batch
+	Body string
+}
+
+// A command, e.g. "Borrowed <tool>". Add new ones with Register.
+type Command struct {
+	// Built from Keywords (and translations, see SetLanguages) and Args
+	matcher *regexp.Regexp
+	// Errors returned are database errors, which abort the whole mail.
+	// Problems with the command itself should go into the report, see
+	// Session.result.
+	Handler func(s *Session, req Request) error
+	// Identifies the command in the language configuration, and in plus
+	// addresses, e.g. "borrow"
+	Name string
+	// The (English) keywords, the first one is used for QR codes and help
+	Keywords []string
+	// Regexp for after the keyword, its submatches go into Request.Args. Can
+	// refer to translatable words in braces, e.g. "{to}", see Words.
+	Args string
+	// For the Help command, e.g. "Borrowed <tool>[, <tool>...]"
+	Usage string
+	Help  string
+	Dkim  DkimPolicy
+	// Can be used in a plus address, e.g. tooltracker+borrow.tool@example.com,
+	// see EncodePlusAddress. The extension becomes the subject "<keyword>
+	// <tool>".
+	Plus bool
+	// Can be a line of a batch mail
+	Batch bool
+	// Also matches an empty subject
+	Empty bool
+}
+
+// In order of matching
+var commands []*Command
+
+func Register(command *Command) {
+	command.compile()
+	commands = append(commands, command)
+}
+
+// All the registered commands, in order of matching
+func Commands() []*Command {
+	return commands
+}
+
+// Find the command for the subject (or batch line), and the matched arguments
+func matchCommand(subject string, batch bool) (*Command, []string) {
+	subject = stripReplyPrefixes(subject)
+	for _, command := range commands {
+		if batch && !command.Batch {
+			continue
+		}
+		if command.Empty && strings.TrimSpace(subject) == "" {
+			return command, []string{subject}
+		}
+		if args := command.matcher.FindStringSubmatch(subject); args != nil {
+			return command, args
+		}
+	}
+	return nil, nil
+}
+
+// Build the matcher from the keywords of all languages
+func (c *Command) compile() {
+	args := wordRe.ReplaceAllStringFunc(c.Args, func(word string) string {
+		word = strings.Trim(word, "{}")
+		return alternatives(slices.Concat(Words[word], translations(word)))
+	})
+	keywords := alternatives(slices.Concat(c.Keywords, translations(c.Name)))
+	c.matcher = regexp.MustCompile(`^(?i)` + keywords + args)
+}
+
+func (c *Command) keyword() string {
+	return c.Keywords[0]
+}
+
+// The list of commands, as sent by Help
+func HelpText() string {
+	ret := "Available commands (in the subject):\n"
+	for _, command := range commands {
+		ret += fmt.Sprintf("\n%s\n", command.Usage)
+		for _, line := range strings.Split(command.Help, "\n") {
+			ret += "    " + line + "\n"
+		}
+		if other := translations(command.Name); other != nil {
+			ret += "    Also: " + strings.Join(other, ", ") + "\n"
+		}
+		if command.Batch {
+			ret += "    Can also be a line in a Batch.\n"
+		}
+	}
+	return ret
+}
+
+// Translatable words used in Command.Args, other than the keywords
+var Words = map[string][]string{
+	"to":    {"to"},
+	"until": {"until"},
+}
+
+var wordRe = regexp.MustCompile(`\{\w+\}`)
+
+// Regexp matching any of the words
+func alternatives(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return `(?:` + strings.Join(quoted, `|`) + `)`
+}
+
+func init() {
+	Register(&Command{
+		Name:     "borrow",
+		Keywords: []string{"Borrowed"},
+		Args:     `[ +](.*)$`,
+		Usage:    "Borrowed <tool>[, <tool>...]",
+		Help:     "Record that you have the tools, the body is a comment (e.g. where).",
+		Plus:     true,
+		Batch:    true,
+		Handler: func(s *Session, req Request) error {
+			return s.processBorrow(req.Body, req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "return",
+		Keywords: []string{"Returned"},
+		Args:     `[ +](.*)$`,
+		Usage:    "Returned <tool>[, <tool>...]",
+		Help:     "Record that you have returned the tools.",
+		Plus:     true,
+		Batch:    true,
+		Handler: func(s *Session, req Request) error {
+			return s.processReturn(req.Body, req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "tag",
+		Keywords: []string{"Tag"},
+		Args:     `[ +](.*)$`,
+		Usage:    "Tag <tool> +<tag> -<tag>...",
+		Help:     "Add/remove tags of the tool.",
+		Batch:    true,
+		Handler: func(s *Session, req Request) error {
+			return s.processTag(req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "describe",
+		Keywords: []string{"Describe"},
+		Args:     `[ +](.*)$`,
+		Usage:    "Describe <tool>",
+		Help:     "Set the description of the tool to the body.",
+		Plus:     true,
+		Handler: func(s *Session, req Request) error {
+			return s.processDescribe(req.Body, req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "photo",
+		Keywords: []string{"Photo"},
+		Args:     `[ +](.*)$`,
+		Usage:    "Photo <tool>",
+		Help:     "Set the image of the tool to the attached image.",
+		Plus:     true,
+		Handler: func(s *Session, req Request) error {
+			return s.processPhoto(*req.Mail, req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "gave",
+		Keywords: []string{"Gave"},
+		// Last " to " so that the tool name can contain " to "
+		Args:  `[ +](.*)\s+{to}\s+(.*)$`,
+		Usage: "Gave <tool> to <e-mail or alias>",
+		Help:  "Record that you have given the tool to someone else.",
+		Batch: true,
+		Handler: func(s *Session, req Request) error {
+			return s.processGave(req.Body, req.Args[1], req.Args[2])
+		},
+	})
+	Register(&Command{
+		Name:     "confirm",
+		Keywords: []string{"Confirm handover"},
+		Args:     `\s+(\S+)`,
+		Usage:    "Confirm handover <token>",
+		Help:     "Confirm someone has given you a tool, reply to the e-mail asking you to.",
+		Handler: func(s *Session, req Request) error {
+			return s.processConfirm(req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "alias",
+		Keywords: []string{"Alias"},
+		Args:     `([ +].*?)?(?:\s+{until}\s+(\d\d\d\d-\d\d-\d\d))?\s*$`,
+		Usage:    "Alias [<e-mail>...] [until <YYYY-MM-DD>]",
+		Help: "Set your name as shown on the tracker to the body.\n" +
+			"The e-mails can then also send commands on your behalf (until the\n" +
+			"end of the day, if given), once they confirm (if configured).\n" +
+			"OpenPGP public keys in the body or attached are registered for the\n" +
+			"e-mails (or yours), commands signed with them are then accepted.",
+		Handler: func(s *Session, req Request) error {
+			// Only set up delegates from the DKIM validated email, to prevent
+			// chains of delegates
+			var delegates *string
+			if *s.From == s.delegate && !strings.HasPrefix(s.pgp, "pass") {
+				delegates = &req.Args[1]
+			}
+			return s.processAlias(req.Body, delegates, req.Args[2], pgpKeysIn(req.Mail))
+		},
+	})
+	Register(&Command{
+		Name:     "confirmAlias",
+		Keywords: []string{"Confirm alias"},
+		Args:     `\s+(\S+)`,
+		Usage:    "Confirm alias <token>",
+		Help:     "Confirm you send commands for someone, reply to the e-mail asking you to.",
+		// The token proves the mail came from the address
+		Dkim: DkimNone,
+		Handler: func(s *Session, req Request) error {
+			return s.processConfirmAlias(req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "confirmKey",
+		Keywords: []string{"Confirm key"},
+		Args:     `\s+(\S+)`,
+		Usage:    "Confirm key <token>",
+		Help:     "Confirm an OpenPGP key is yours, reply to the e-mail asking you to.",
+		// The token proves the mail came from the address
+		Dkim: DkimNone,
+		Handler: func(s *Session, req Request) error {
+			return s.processConfirmPgpKey(req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "unalias",
+		Keywords: []string{"Unalias"},
+		Args:     `[ +](.*)$`,
+		Usage:    "Unalias <e-mail>",
+		Help:     "Stop the e-mail sending commands on your behalf.",
+		Handler: func(s *Session, req Request) error {
+			return s.processUnalias(req.Args[1])
+		},
+	})
+	Register(&Command{
+		Name:     "help",
+		Keywords: []string{"Help"},
+		Args:     `\s*$`,
+		Usage:    "Help",
+		Help:     "Reply with this list of commands.",
+		// Needs verifying like any other command, so that forged mail can't
+		// make us reply to someone else
+		Handler: func(s *Session, req Request) error {
+			return s.processHelp()
+		},
+	})
+	Register(&Command{
+		Name:     "batch",
+		Keywords: []string{"Batch"},
+		Args:     `\s*$`,
+		Usage:    "Batch",
+		Help: "Run the commands in the body, one per line, e.g.\n" +
+			"    Borrowed scope\n" +
+			"    Tag scope +lab2\n" +
+			"An empty subject also works.",
+		Empty: true,
+		Handler: func(s *Session, req Request) error {
+			return s.processBatch(req.Mail, req.Body)
+		},
+	})
+}
@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+func TestHelp(t *testing.T) {
+	conn, s := setup(t, Domain1, true, false)
+	defer conn.Close()
+
+	sender := &fakeSender{}
+	s.Sender = sender
+
+	// Not verified, e.g. a forged From, so no reply
+	s.From = &User3
+	if outcome := s.Handle(newPlain(User3, To, "Help", "")); outcome.Err != ErrInvalid {
+		t.Fatalf("Expected %v, got %v", ErrInvalid, outcome.Err)
+	}
+	if len(sender.sent) != 0 {
+		t.Fatalf("Expected no reply to unverified sender, got %v", sender.sent)
+	}
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, "Help", "")).Err)
+
+	if len(sender.sent) != 1 || sender.sent[0].To != User1 {
+		t.Fatalf("Expected help to be sent to %s, got %v", User1, sender.sent)
+	}
+	for _, command := range Commands() {
+		if !strings.Contains(sender.sent[0].Body, command.Usage) {
+			t.Fatalf("Expected help to contain %q, got:\n%s", command.Usage, sender.sent[0].Body)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	saved := commands
+	defer func() { commands = saved }()
+
+	var got string
+	Register(&Command{
+		Name:     "ping",
+		Keywords: []string{"Ping"},
+		Args:     ` (.*)$`,
+		Usage:    "Ping <text>",
+		Help:     "Test command.",
+		Handler: func(s *Session, req Request) error {
+			got = req.Args[1]
+			s.result("Ping", nil)
+			return nil
+		},
+	})
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, "Ping pong", "")).Err)
+	if got != "pong" {
+		t.Fatalf("Expected handler to get %q, got %q", "pong", got)
+	}
+}
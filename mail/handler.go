@@ -2,101 +2,504 @@ package mail
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"blitiri.com.ar/go/spf"
 	"github.com/KoviRobi/tooltracker/db"
+	"github.com/KoviRobi/tooltracker/limits"
+	"github.com/KoviRobi/tooltracker/ratelimit"
+	"github.com/KoviRobi/tooltracker/tags"
+	"github.com/KoviRobi/tooltracker/toolname"
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dkim"
-	"github.com/k3a/html2text"
 	"github.com/mcnijman/go-emailaddress"
 	"github.com/mnako/letters"
 )
 
 // Data passed around during the processing of a single mail
 type Session struct {
-	Db        db.DB
-	From      *string
-	Dkim      string
-	Delegate  bool
-	LocalDkim bool
+	Db   db.DB
+	From *string
+	Dkim string
+	// Used to send e-mails, e.g. to confirm handovers, can be nil
+	Sender Sender
+	// The tooltracker's own address, which replies should go to
+	To string
+	// Envelope recipient, if known, otherwise the Delivered-To/To headers are
+	// used. Can have a command in the plus extension, see EncodePlusAddress.
+	Rcpt string
+	// Trust the Authentication-Results header from the MTA with this
+	// authserv-id, see trustedAuthResults. Empty to always check DKIM.
+	AuthservId string
+	// Trust the ARC-Authentication-Results sealed by these domains, see
+	// checkArc. Empty to ignore ARC.
+	ArcSealers []string
+	// Accept S/MIME signatures by certificates for the sender from these CAs,
+	// see checkSmime. nil to ignore S/MIME.
+	SmimeRoots *x509.CertPool
+	// How the sender's domain can be verified, nil for DKIM only
+	Accept []AuthMethod
+	// The SMTP client, for SPF, nil if unknown (e.g. IMAP)
+	ClientIp        net.IP
+	Helo            string
+	Delegate        bool
+	LocalDkim       bool
+	ConfirmHandover bool
+	// Ask the e-mails in an Alias to confirm, before they can act for the
+	// sender. Needs a Sender.
+	ConfirmDelegation bool
+	// Per sender and per tool rate limits, and the cap on new tools
+	Limits ratelimit.Limits
+	// Only accept tools added on the web UI, see ErrNotRegistered
+	RegisteredOnly bool
+	// Borrowed needs the token from the QR code, see QrToken. nil to accept
+	// any subject.
+	QrKey []byte
+	// Tool names are matched to existing ones, see resolveTool. Those within
+	// ToolAutocorrect edits of one are corrected to it (unless a whole word is
+	// different, see toolname.DifferentWords), within ToolSuggest the command
+	// is rejected with suggestions.
+	ToolAutocorrect int
+	ToolSuggest     int
+	// Filled in with the result of each command processed from this mail
+	Report Report
+	// Sent once the mail has been processed successfully
+	Outbox []Outgoing
+	// Who the sender is acting for, see Handle
+	delegate string
+	// When the mail was sent, nil if unknown
+	date *time.Time
+	// The subject the command came from, which a signature (S/MIME or OpenPGP)
+	// has to cover, see signsSubject
+	subject string
+	// Filled in for the Outcome
+	command       string
+	tools         []string
+	rejection     Rejection
+	reason        error
+	verifications []*dkim.Verification
+	authResults   []authres.Result
+	spf           spf.Result
+	dmarc         string
+	arc           string
+	smime         string
+	pgp           string
+}
+
+// Why a mail was rejected
+type Rejection int
+
+const (
+	NotRejected Rejection = iota
+	RejectNoSender
+	RejectUnparsable
+	RejectBadCommand
+	RejectNotVerified
+	RejectRateLimited
+)
+
+func (r Rejection) String() string {
+	switch r {
+	case NotRejected:
+		return "Not rejected"
+	case RejectNoSender:
+		return "No sender"
+	case RejectUnparsable:
+		return "Unparsable"
+	case RejectBadCommand:
+		return "Bad command"
+	case RejectNotVerified:
+		return "Sender not verified"
+	case RejectRateLimited:
+		return "Rate limited"
+	}
+	return fmt.Sprintf("Rejection(%d)", int(r))
+}
+
+// What happened to a mail, see Handle
+type Outcome struct {
+	// nil, ErrInvalid if the mail was rejected, or a database error (which is
+	// worth retrying)
+	Err error
+	// More detail on why the mail was rejected
+	Reason error
+	// Name of the command, e.g. "borrow", see Command.Name
+	Command string
+	// Who the sender is acting for, after delegation
+	Sender string
+	// Tools affected by the command(s)
+	Tools []string
+	// Results of each command
+	Report Report
+	// DKIM signatures checked, nil if they weren't
+	Verifications []*dkim.Verification
+	// From the trusted upstream MTA, see Session.AuthservId
+	AuthResults []authres.Result
+	// Empty if not checked, see Session.Accept
+	Spf   spf.Result
+	Dmarc string
+	// ARC chain validation, empty if not checked, see Session.ArcSealers
+	Arc string
+	// S/MIME signature, empty if not checked, see Session.SmimeRoots
+	Smime string
+	// Signature with the sender's registered key, empty if they don't have one,
+	// see RequestPgpKey
+	Pgp       string
+	Rejection Rejection
+}
+
+// Whether the mail was rejected for good (e.g. spam), so it is quarantined
+// rather than retried like rate limited ones, which will get through once the
+// bucket refills
+func (o Outcome) Quarantined() bool {
+	return errors.Is(o.Err, ErrInvalid) && o.Rejection != RejectRateLimited
+}
+
+// The DKIM signatures checked, for an admin to look at
+func (o Outcome) VerificationSummary() string {
+	ret := ""
+	if o.AuthResults != nil {
+		ret += "Trusted Authentication-Results: " + authres.Format("", o.AuthResults) + "\n"
+	}
+	if o.Spf != "" {
+		ret += fmt.Sprintf("SPF: %s\n", o.Spf)
+	}
+	if o.Dmarc != "" {
+		ret += fmt.Sprintf("DMARC: %s\n", o.Dmarc)
+	}
+	if o.Arc != "" {
+		ret += fmt.Sprintf("ARC: %s\n", o.Arc)
+	}
+	if o.Smime != "" {
+		ret += fmt.Sprintf("S/MIME: %s\n", o.Smime)
+	}
+	if o.Pgp != "" {
+		ret += fmt.Sprintf("OpenPGP: %s\n", o.Pgp)
+	}
+	if o.Verifications == nil {
+		return ret + "DKIM not checked"
+	}
+	for _, verification := range o.Verifications {
+		if verification == nil {
+			continue
+		}
+		status := "OK"
+		if verification.Err != nil {
+			status = verification.Err.Error()
+		}
+		ret += fmt.Sprintf("DKIM %s: %s\n", verification.Domain, status)
+	}
+	if len(o.Verifications) == 0 {
+		ret += "No DKIM signatures"
+	}
+	return ret
+}
+
+// The outcome of a single command, e.g. one line of a batch
+type Result struct {
+	Err     error
+	Command string
+}
+
+type Report []Result
+
+func (r Report) String() string {
+	ret := ""
+	for _, result := range r {
+		status := "OK"
+		if result.Err != nil {
+			status = result.Err.Error()
+		}
+		ret += fmt.Sprintf("%s: %s\n", result.Command, status)
+	}
+	return ret
 }
 
 var ErrInvalid = errors.New("Invalid email")
+var ErrBadCommand = errors.New("Bad command")
+var ErrNoFrom = errors.New("No sender")
+var ErrNotVerified = errors.New("Sender not verified")
+var ErrDuplicate = errors.New("Already processed")
+var ErrNoSender = errors.New("Can't send e-mails, no relay configured")
+var ErrNoTool = errors.New("Missing tool name, or only punctuation")
+var ErrNoTags = errors.New("Missing +tag/-tag")
+var ErrNoImage = errors.New("No image attached")
+var ErrNoRecipient = errors.New("Unknown recipient, use an e-mail address or alias")
+var ErrAmbiguousRecipient = errors.New("Ambiguous recipient, use an e-mail address")
+var ErrNoHandover = errors.New("No such handover, perhaps already confirmed")
+var ErrWrongRecipient = errors.New("Handover was for someone else")
+var ErrNoDelegation = errors.New("No such delegation, perhaps already confirmed")
+var ErrWrongDelegate = errors.New("Delegation was for someone else")
+var ErrBadDate = errors.New("Bad date, expected YYYY-MM-DD")
+var ErrRateLimited = errors.New("Too many mails, try again later")
+var ErrToolRateLimited = errors.New("Tool changed too often, try again later")
+var ErrTooManyTools = errors.New("Too many new tools today, try again tomorrow")
+var ErrUnknownTool = errors.New("Unknown tool")
+var ErrImageTooBig = fmt.Errorf("Image too big (max %d KiB)", limits.MaxImageBytes/1024)
 
 var verifyOptions = dkim.VerifyOptions{
-	LookupTXT: net.LookupTXT,
+	LookupTXT: lookupTXT,
 }
 
-// Treat a double newline as a signature delimiter
-var signatureRe = regexp.MustCompile(`(\p{Zs}*\r?\n){2}`)
-// Fix up divs to contain an extra new-line -- simple work-around to signatures
-// being separated by `</div>` and `<br>`
-var htmlNewlineTags = regexp.MustCompile(`</\s*div>`)
+// Several tools can be given at once, e.g. "Borrowed scope, probe set, PSU"
+var toolSeparatorRe = regexp.MustCompile(`\s*,\s*`)
 
-var borrowRe = regexp.MustCompile(`^(?i)Borrowed[ +](.*)$`)
+// Tags to add/remove in "Tag <tool> +tag -tag", at the end of the line
+var tagSuffixRe = regexp.MustCompile(`(\s+[+-][a-zA-Z][a-zA-Z0-9_]*)+\s*$`)
 
-// Handle "Re:" and other localised versions
-// TODO: Non-ASCII?
-var aliasRe = regexp.MustCompile(`^(?i)(\w*:\s*)?Alias([ +].*)?\b`)
+const returnedComment = "Returned"
 
-func (s *Session) Handle(buf []byte) error {
+func (s *Session) Handle(buf []byte) Outcome {
+	s.command, s.tools, s.rejection, s.reason = "", nil, NotRejected, nil
+	s.verifications, s.authResults, s.spf, s.dmarc, s.arc, s.smime, s.pgp = nil, nil, "", "", "", "", ""
+	err := s.handle(buf)
+	return Outcome{
+		Err:           err,
+		Reason:        s.reason,
+		Command:       s.command,
+		Sender:        s.delegate,
+		Tools:         s.tools,
+		Report:        s.Report,
+		Verifications: s.verifications,
+		AuthResults:   s.authResults,
+		Spf:           s.spf,
+		Dmarc:         s.dmarc,
+		Arc:           s.arc,
+		Smime:         s.smime,
+		Pgp:           s.pgp,
+		Rejection:     s.rejection,
+	}
+}
+
+func (s *Session) handle(buf []byte) error {
 	reader := bytes.NewReader(buf)
 
 	if s.From == nil {
 		log.Println("No `from` in for this mail")
-		return ErrInvalid
+		return s.reject(RejectNoSender, ErrNoFrom)
 	}
 
 	// Delegation example: Assuming Dkim is work.com but bob@work.com has sent
 	// "Alias bob@family.net", then delegate of bob@family.net is
 	// bob@work.com (if delegation is enabled, otherwise it is unchanged)
-	delegate := *s.From
+	s.delegate = *s.From
 	if s.Delegate {
-		delegate = s.Db.GetDelegatedEmailFor(*s.From)
+		s.delegate = s.Db.GetDelegatedEmailFor(*s.From)
 	}
 
-	err := s.verifyMail(delegate, reader)
-	if err != nil {
-		return err
-	}
-
-	reader.Seek(0, io.SeekStart)
 	m, err := letters.ParseEmail(reader)
 	if err != nil {
 		log.Printf("Error parsing e-mail: %v", err)
-		return ErrInvalid
+		return s.reject(RejectUnparsable, fmt.Errorf("Error parsing e-mail: %w", err))
 	}
 
 	subject := m.Headers.Subject
-	body := m.Text
-	if body == "" {
-		m.HTML = htmlNewlineTags.ReplaceAllString(m.HTML, `$1<br>`)
-		body = html2text.HTML2Text(m.HTML)
-	}
-	signatureStart := signatureRe.FindStringIndex(body)
-	if signatureStart != nil {
-		body = body[:signatureStart[0]]
-	}
-	body = strings.TrimSpace(body)
+	body := ExtractBody(m)
 	log.Printf("Mail body: %q", body[:min(len(body), 100)])
-	if borrow := borrowRe.FindStringSubmatch(subject); borrow != nil {
-		return s.processBorrow(body, borrow[1])
-	} else if alias := aliasRe.FindStringSubmatch(subject); alias != nil {
-		// Only set up delegates from the DKIM validated email, to prevent chains of
-		// delegates
-		var delegates *string
-		if *s.From == delegate {
-			delegates = &alias[2]
-		}
-		return s.processAlias(body, delegates)
-	} else {
+
+	command, args := matchCommand(subject, false)
+	// The recipient isn't covered by the signature, so it is only used if the
+	// mail client dropped the subject, otherwise a signed mail could be resent
+	// to another plus address to run a different command
+	if command == nil || command.Empty {
+		if extension := s.plusExtension(m); extension != "" {
+			if plusCommand, ok := decodePlusCommand(extension); ok {
+				log.Printf("Using command %q from recipient instead of subject %q", plusCommand, subject)
+				subject = plusCommand
+				command, args = matchCommand(subject, false)
+			}
+		}
+	}
+	if command == nil {
 		log.Println("Bad command", subject)
-		return ErrInvalid
+		return s.reject(RejectBadCommand, fmt.Errorf("%w %q", ErrBadCommand, subject))
+	}
+	s.command = command.Name
+	s.subject = subject
+	// A clearsigned command repeats the subject as its first line (see
+	// verifyPgp), which isn't part of the comment
+	if first, rest, _ := strings.Cut(body, "\n"); subject != "" &&
+		strings.TrimSpace(first) == strings.TrimSpace(subject) {
+		body = strings.TrimSpace(rest)
+	}
+
+	if command.Dkim == DkimRequired {
+		err = s.verifyMail(s.delegate, reader)
+		if err != nil {
+			return err
+		}
+
+		// Only once verified, otherwise a forged From would use up someone
+		// else's allowance. The other commands only check a token.
+		if !s.Limits.Sender.Allow(strings.ToLower(s.delegate)) {
+			log.Printf("Rate limiting %s", s.delegate)
+			return s.reject(RejectRateLimited, fmt.Errorf("%w (%s)", ErrRateLimited, s.delegate))
+		}
+	}
+
+	s.date = mailDate(m)
+	id := mailId(m, buf)
+	err = s.transaction(func(s *Session) error {
+		first, err := s.Db.MarkProcessed(id)
+		if err != nil {
+			return err
+		}
+		if !first {
+			log.Printf("Skipping already processed mail %s", id)
+			s.result(subject, ErrDuplicate)
+			return nil
+		}
+		return command.Handler(s, Request{Mail: &m, Args: args, Body: body})
+	})
+
+	log.Printf("Report for mail from %s:\n%s", *s.From, s.Report)
+	if err == nil {
+		s.sendOutbox()
+	}
+	return err
+}
+
+// The mail is invalid, see Outcome.Rejection
+func (s *Session) reject(rejection Rejection, reason error) error {
+	s.rejection = rejection
+	s.reason = reason
+	return ErrInvalid
+}
+
+// Only send once the database changes have been committed, so that we don't
+// e.g. ask to confirm a handover which got rolled back
+func (s *Session) sendOutbox() {
+	if s.Sender == nil {
+		return
+	}
+	for _, out := range s.Outbox {
+		err := s.Sender.Send(out)
+		if err != nil {
+			log.Printf("Error sending mail: %v", err)
+		}
+	}
+}
+
+// Identifies the mail to skip redelivered ones, the Message-ID if there is
+// one, otherwise a hash of the mail
+func mailId(m letters.Email, buf []byte) string {
+	if m.Headers.MessageID != "" {
+		return "<" + string(m.Headers.MessageID) + ">"
+	}
+	hash := sha256.Sum256(buf)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// When the mail was sent, according to the Date header. Not in the future, so
+// that a bad clock can't stop later updates.
+func mailDate(m letters.Email) *time.Time {
+	date := m.Headers.Date
+	if date.IsZero() {
+		return nil
+	}
+	if now := time.Now(); date.After(now) {
+		date = now
+	}
+	return &date
+}
+
+// Find the plus extension of the address this mail was sent to
+func (s *Session) plusExtension(m letters.Email) string {
+	if s.To == "" {
+		return ""
+	}
+	recipients := []string{s.Rcpt}
+	recipients = append(recipients, m.Headers.ExtraHeaders["Delivered-To"]...)
+	for _, to := range m.Headers.To {
+		recipients = append(recipients, to.Address)
+	}
+	for _, recipient := range recipients {
+		if extension, ok := SplitPlusAddress(recipient, s.To); ok && extension != "" {
+			return extension
+		}
+	}
+	return ""
+}
+
+// Run the commands with a session whose database is inside a transaction, so
+// that either all of them apply or none of them do
+func (s *Session) transaction(fn func(s *Session) error) error {
+	err := s.Db.Transaction(func(tx db.DB) error {
+		txSession := *s
+		txSession.Db = tx
+		err := fn(&txSession)
+		s.Report = txSession.Report
+		s.Outbox = txSession.Outbox
+		s.tools = txSession.tools
+		return err
+	})
+	if err != nil {
+		log.Printf("Rolled back, error processing mail: %v", err)
+	}
+	return err
+}
+
+func (s *Session) result(command string, err error) {
+	s.Report = append(s.Report, Result{Command: command, Err: err})
+}
+
+// Record that the tool was changed, for the Outcome
+func (s *Session) affected(tool string) {
+	s.tools = append(s.tools, tool)
+}
+
+// Process commands from the body, one per line, in order
+func (s *Session) processBatch(m *letters.Email, body string) error {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		command, args := matchCommand(line, true)
+		if command == nil {
+			s.result(line, ErrBadCommand)
+			continue
+		}
+		err := command.Handler(s, Request{Mail: m, Args: args})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reply with the list of commands
+func (s *Session) processHelp() error {
+	if s.Sender == nil {
+		s.result("Help", ErrNoSender)
+		return nil
 	}
+	s.Outbox = append(s.Outbox, Outgoing{
+		To:      *s.From,
+		Subject: "Re: Help",
+		Body:    HelpText(),
+	})
+	s.result("Help", nil)
+	return nil
+}
+
+// Split "scope, probe set, PSU" into the individual tool names
+func splitTools(tools string) []string {
+	return toolSeparatorRe.Split(strings.TrimSpace(tools), -1)
 }
 
 func (s *Session) verifyMail(delegate string, reader *bytes.Reader) error {
@@ -105,7 +508,7 @@ func (s *Session) verifyMail(delegate string, reader *bytes.Reader) error {
 		address, err := emailaddress.Parse(*s.From)
 		if err != nil {
 			log.Printf("Error parsing e-mail address %v", err)
-			return ErrInvalid
+			return s.reject(RejectNotVerified, fmt.Errorf("Error parsing e-mail address: %w", err))
 		}
 		// At this point, we must have set an alias delegate using DKIM valid alias
 		// command
@@ -116,63 +519,620 @@ func (s *Session) verifyMail(delegate string, reader *bytes.Reader) error {
 		}
 
 		reader.Seek(0, io.SeekStart)
-		verifications, err := dkim.VerifyWithOptions(reader, &verifyOptions)
-		if err != nil {
-			log.Printf("Error trying to verify e-mail: %v", err)
-			return ErrInvalid
+		if s.checkPgp(reader) {
+			return nil
+		}
+
+		if s.AuthservId != "" {
+			reader.Seek(0, io.SeekStart)
+			s.authResults = trustedAuthResults(reader, s.AuthservId)
+			if authResultsPass(s.authResults, dkimDomain) {
+				return nil
+			}
+		}
+
+		if len(s.ArcSealers) > 0 {
+			reader.Seek(0, io.SeekStart)
+			if s.checkArc(reader, dkimDomain) {
+				return nil
+			}
+		}
+
+		if s.SmimeRoots != nil {
+			reader.Seek(0, io.SeekStart)
+			if s.checkSmime(reader, dkimDomain) {
+				return nil
+			}
 		}
 
-		verified := false
-		for _, verification := range verifications {
-			if verification != nil {
-				if verification.Err == nil {
-					if verification.Domain == dkimDomain {
-						verified = true
+		// Domains with a valid DKIM signature, also needed for DMARC
+		var dkimDomains []string
+		if s.accepts(AuthDkim) || s.accepts(AuthDmarc) {
+			reader.Seek(0, io.SeekStart)
+			verifications, err := dkim.VerifyWithOptions(reader, &verifyOptions)
+			s.verifications = verifications
+			if err != nil {
+				log.Printf("Error trying to verify e-mail: %v", err)
+				return s.reject(RejectNotVerified, fmt.Errorf("Error trying to verify e-mail: %w", err))
+			}
+			for _, verification := range verifications {
+				if verification != nil {
+					if verification.Err == nil {
+						dkimDomains = append(dkimDomains, verification.Domain)
 					} else {
-						log.Printf("Verified %s but not the one we are looking for: %s\n",
-							verification.Domain, dkimDomain)
+						log.Printf("Failed to verify %s: %s\n", verification.Domain, verification.Err)
 					}
-				} else {
-					log.Printf("Failed to verify %s: %s\n", verification.Domain, verification.Err)
 				}
 			}
 		}
-		if !verified {
-			log.Println("Failed to verify message")
-			return ErrInvalid
+		if s.accepts(AuthDkim) {
+			if slices.Contains(dkimDomains, dkimDomain) {
+				return nil
+			}
+			for _, domain := range dkimDomains {
+				log.Printf("Verified %s but not the one we are looking for: %s\n",
+					domain, dkimDomain)
+			}
+		}
+
+		if s.accepts(AuthSpf) || s.accepts(AuthDmarc) {
+			s.spf = s.checkSpf()
 		}
+		if s.accepts(AuthSpf) && s.spf == spf.Pass && domainOf(*s.From) == strings.ToLower(dkimDomain) {
+			return nil
+		}
+
+		if s.accepts(AuthDmarc) {
+			reader.Seek(0, io.SeekStart)
+			fromDomain := headerFromDomain(reader)
+			s.dmarc = s.checkDmarc(fromDomain, dkimDomains, s.spf)
+			if s.dmarc == "pass" && fromDomain == strings.ToLower(dkimDomain) {
+				return nil
+			}
+		}
+
+		log.Println("Failed to verify message")
+		return s.reject(RejectNotVerified, fmt.Errorf("%w, expected %s from %s",
+			ErrNotVerified, s.acceptedMethods(), dkimDomain))
+	}
+
+	return nil
+}
+
+// For the rejection reason, e.g. "dkim or dmarc"
+func (s *Session) acceptedMethods() string {
+	if s.Accept == nil {
+		return string(AuthDkim)
+	}
+	var methods []string
+	for _, method := range s.Accept {
+		methods = append(methods, string(method))
 	}
+	return strings.Join(methods, " or ")
+}
 
+// Update the location as of when this mail was sent, an outdated location
+// (e.g. a delayed mail) only goes into the report
+func (s *Session) updateLocation(command string, tool db.Tool, location db.Location) error {
+	location.Tool = tool.Id
+	location.LastSeenAt = s.date
+	err := s.Db.UpdateLocation(location)
+	if errors.Is(err, db.ErrOutdated) {
+		s.result(command, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.affected(tool.Name)
+	s.result(command, nil)
 	return nil
 }
 
+// Check the tool's rate limit. Reports the command if not allowed.
+func (s *Session) allowTool(command string, tool db.Tool) bool {
+	if !s.Limits.Tool.Allow(tool.Id) {
+		s.result(command, ErrToolRateLimited)
+		return false
+	}
+	return true
+}
+
+// Check new tools are accepted (see RegisteredOnly), and the cap on them.
+// Reports the command if not allowed.
+func (s *Session) allowNewTool(command, name string) bool {
+	if s.RegisteredOnly {
+		s.result(command, ErrNotRegistered)
+		s.replyNotRegistered(name)
+		return false
+	}
+	if !s.Limits.NewTools.Take() {
+		s.result(command, ErrTooManyTools)
+		return false
+	}
+	return true
+}
+
+// The existing tool the argument refers to, by its name (e.g. "scope-3" for
+// "Scope 3"), an old name (see db.RenameTool) or its ID (e.g. from a QR code,
+// first if byId, so that a tool named like another's ID can't shadow it),
+// otherwise a new tool, without an Id. Reports the command if the name is too
+// close to existing tools to tell.
+func (s *Session) resolveTool(command, name string, byId bool) (db.Tool, bool) {
+	name = strings.TrimSpace(name)
+	if byId {
+		if tool := s.Db.GetTool(strings.ToLower(name)); tool.Id != "" {
+			return tool, true
+		}
+	}
+	matches := toolname.Find(name, s.Db.GetToolNames(), max(s.ToolAutocorrect, s.ToolSuggest))
+	if len(matches) > 0 && matches[0].Distance == 0 {
+		if matches[0].Name != name {
+			log.Printf("Using tool %q for %q", matches[0].Name, name)
+		}
+		return s.Db.GetToolByName(matches[0].Name), true
+	}
+	// Renamed, e.g. an old QR code
+	canonical := toolname.Canonical(name)
+	for _, alias := range s.Db.GetToolAliases() {
+		if toolname.Canonical(alias.Alias) == canonical {
+			tool := s.Db.GetTool(alias.Tool)
+			log.Printf("Using tool %q for its old name %q", tool.Name, name)
+			return tool, true
+		}
+	}
+	// E.g. a QR code without a token, see QrKey
+	if tool := s.Db.GetTool(strings.ToLower(name)); tool.Id != "" {
+		return tool, true
+	}
+	if len(matches) == 0 {
+		return db.Tool{Name: name}, true
+	}
+	best := matches[0]
+	unambiguous := len(matches) == 1 || matches[1].Distance > best.Distance
+	// Only suggested if a whole word is different, e.g. "Probe B" for "Probe A"
+	if best.Distance <= s.ToolAutocorrect && unambiguous && !toolname.DifferentWords(name, best.Name) {
+		log.Printf("Using tool %q for %q", best.Name, name)
+		return s.Db.GetToolByName(best.Name), true
+	}
+
+	var suggestions []string
+	for _, match := range matches {
+		suggestions = append(suggestions, strconv.Quote(match.Name))
+	}
+	s.result(command, fmt.Errorf("%w %q, did you mean %s? (New tools can be added on the web UI)",
+		ErrUnknownTool, name, strings.Join(suggestions, " or ")))
+	return db.Tool{}, false
+}
+
+// The tool the command is for, see resolveTool, added to the database if it is
+// new. The name can end with the token from the QR code, see validQrToken.
+// Reports the command (and returns false) if it is unknown or not allowed,
+// see allowNewTool and allowTool.
+func (s *Session) toolFor(command, name string) (db.Tool, bool, error) {
+	name, token := splitQrToken(name)
+	if toolname.Canonical(name) == "" {
+		s.result(command, ErrNoTool)
+		return db.Tool{}, false, nil
+	}
+	// Only QR codes have tokens, and they use the ID
+	tool, ok := s.resolveTool(command, name, token != "")
+	if !ok {
+		return tool, false, nil
+	}
+	if !s.validQrToken(tool, token) {
+		s.result(command, ErrNoQrToken)
+		return tool, false, nil
+	}
+	if tool.Id == "" {
+		if !s.allowNewTool(command, tool.Name) {
+			return tool, false, nil
+		}
+		var err error
+		tool, err = s.Db.AddTool(tool.Name)
+		if err != nil {
+			return tool, false, err
+		}
+		log.Printf("Added tool %q as %s", tool.Name, tool.Id)
+	}
+	if !s.allowTool(command, tool) {
+		return tool, false, nil
+	}
+	if tool.Tags == nil {
+		tool.Tags = make(tags.Tags)
+	}
+	return tool, true, nil
+}
+
+// Errors returned are database errors, which abort the whole mail. Problems
+// with individual commands only go into the report.
 func (s *Session) processBorrow(body, borrow string) error {
-	location := db.Location{
-		Tool:       borrow,
-		LastSeenBy: *s.From,
-		Comment:    &body,
+	for _, name := range splitTools(borrow) {
+		if name == "" {
+			s.result("Borrowed "+borrow, ErrNoTool)
+			continue
+		}
+		tool, ok, err := s.toolFor("Borrowed "+name, name)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		err = s.updateLocation("Borrowed "+tool.Name, tool, db.Location{
+			LastSeenBy: *s.From,
+			Comment:    &body,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) processReturn(body, returned string) error {
+	if body == "" {
+		body = returnedComment
+	}
+	for _, name := range splitTools(returned) {
+		if name == "" {
+			s.result("Returned "+returned, ErrNoTool)
+			continue
+		}
+		tool, ok, err := s.toolFor("Returned "+name, name)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		err = s.updateLocation("Returned "+tool.Name, tool, db.Location{
+			LastSeenBy: *s.From,
+			Comment:    &body,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add/remove tags, e.g. "probe set +lab2 -lab1"
+func (s *Session) processTag(args string) error {
+	command := "Tag " + args
+	suffix := tagSuffixRe.FindStringIndex(args)
+	if suffix == nil {
+		s.result(command, ErrNoTags)
+		return nil
+	}
+	name := strings.TrimSpace(args[:suffix[0]])
+	if name == "" {
+		s.result(command, ErrNoTool)
+		return nil
+	}
+	changes := tags.NormalizeTags([]string{args[suffix[0]:]})
+	tool, ok, err := s.toolFor(command, name)
+	if err != nil || !ok {
+		return err
+	}
+
+	for tag, tagType := range changes {
+		if tagType == tags.Not {
+			delete(tool.Tags, tag)
+		} else {
+			tool.Tags[tag] = tags.Any
+		}
+	}
+	err = s.Db.UpdateTool(tool)
+	if err != nil {
+		return err
+	}
+	s.affected(tool.Name)
+	s.result(command, nil)
+
+	return nil
+}
+
+// The body becomes the description of the tool
+func (s *Session) processDescribe(body, name string) error {
+	command := "Describe " + name
+	name = strings.TrimSpace(name)
+	if name == "" {
+		s.result(command, ErrNoTool)
+		return nil
+	}
+
+	tool, ok, err := s.toolFor(command, name)
+	if err != nil || !ok {
+		return err
+	}
+	tool.Description = &body
+	err = s.Db.UpdateTool(tool)
+	if err != nil {
+		return err
+	}
+	s.affected(tool.Name)
+	s.result(command, nil)
+
+	return nil
+}
+
+// The first attached (or inline) image becomes the image of the tool
+func (s *Session) processPhoto(m letters.Email, name string) error {
+	command := "Photo " + name
+	name = strings.TrimSpace(name)
+	if name == "" {
+		s.result(command, ErrNoTool)
+		return nil
+	}
+
+	var image []byte
+	for _, file := range m.AttachedFiles {
+		if strings.HasPrefix(file.ContentType.ContentType, "image/") {
+			image = file.Data
+			break
+		}
+	}
+	if image == nil {
+		for _, file := range m.InlineFiles {
+			if strings.HasPrefix(file.ContentType.ContentType, "image/") {
+				image = file.Data
+				break
+			}
+		}
+	}
+	if image == nil {
+		s.result(command, ErrNoImage)
+		return nil
+	}
+	if len(image) > limits.MaxImageBytes {
+		s.result(command, ErrImageTooBig)
+		return nil
+	}
+
+	tool, ok, err := s.toolFor(command, name)
+	if err != nil || !ok {
+		return err
+	}
+	tool.Image = base64.StdEncoding.EncodeToString(image)
+	err = s.Db.UpdateTool(tool)
+	if err != nil {
+		return err
 	}
-	s.Db.UpdateLocation(location)
+	s.affected(tool.Name)
+	s.result(command, nil)
 
 	return nil
 }
 
-func (s *Session) processAlias(body string, delegateFrom *string) error {
-	s.Db.UpdateAlias(db.Alias{
+// Resolve an e-mail address or an alias to an e-mail address
+func (s *Session) resolveRecipient(recipient string) (string, error) {
+	if address, err := emailaddress.Parse(strings.TrimSpace(recipient)); err == nil {
+		return address.String(), nil
+	}
+	emails := s.Db.GetEmailsForAlias(recipient)
+	switch len(emails) {
+	case 0:
+		return "", ErrNoRecipient
+	case 1:
+		return emails[0], nil
+	default:
+		return "", ErrAmbiguousRecipient
+	}
+}
+
+// Record that the sender gave the tool to someone else, if handovers need to
+// be confirmed then ask the recipient first
+func (s *Session) processGave(body, name, recipient string) error {
+	command := "Gave " + name + " to " + recipient
+	name = strings.TrimSpace(name)
+	if name == "" {
+		s.result(command, ErrNoTool)
+		return nil
+	}
+	to, err := s.resolveRecipient(recipient)
+	if err != nil {
+		s.result(command, err)
+		return nil
+	}
+
+	comment := fmt.Sprintf("Given by %s", *s.From)
+	if body != "" {
+		comment += ": " + body
+	}
+
+	tool, ok, err := s.toolFor(command, name)
+	if err != nil || !ok {
+		return err
+	}
+
+	if !s.ConfirmHandover || s.Sender == nil {
+		return s.updateLocation(command, tool, db.Location{
+			LastSeenBy: to,
+			Comment:    &comment,
+		})
+	}
+
+	token := make([]byte, 8)
+	_, err = rand.Read(token)
+	if err != nil {
+		return err
+	}
+	handover := db.Handover{
+		Token:   hex.EncodeToString(token),
+		Tool:    tool.Id,
+		From:    *s.From,
+		To:      to,
+		Comment: &comment,
+	}
+	err = s.Db.AddHandover(handover)
+	if err != nil {
+		return err
+	}
+	s.Outbox = append(s.Outbox, Outgoing{
+		To:      to,
+		Subject: "Confirm handover " + handover.Token,
+		Body: fmt.Sprintf(
+			"%s says they gave you %q.\n\nPlease reply to this e-mail (to %s) to confirm.\n",
+			*s.From, tool.Name, s.To),
+	})
+	s.affected(tool.Name)
+	s.result(command, nil)
+
+	return nil
+}
+
+// The recipient confirmed they got the tool
+func (s *Session) processConfirm(token string) error {
+	command := "Confirm handover " + token
+	handover, err := s.Db.TakeHandover(token)
+	if err != nil {
+		return err
+	}
+	if handover == nil {
+		s.result(command, ErrNoHandover)
+		return nil
+	}
+	if !strings.EqualFold(handover.To, *s.From) {
+		s.result(command, ErrWrongRecipient)
+		// Put it back for the right recipient
+		return s.Db.AddHandover(*handover)
+	}
+
+	tool := s.Db.GetTool(handover.Tool)
+	command = "Confirm handover of " + tool.Name
+	if !s.allowTool(command, tool) {
+		return nil
+	}
+	return s.updateLocation(command, tool, db.Location{
+		LastSeenBy: handover.To,
+		Comment:    handover.Comment,
+	})
+}
+
+// Set the alias of the sender, and let the e-mails in delegateFrom act for the
+// sender (until the end of the expires day, if given), once they confirm if
+// delegations need to be confirmed
+func (s *Session) processAlias(body string, delegateFrom *string, expires string, keys []string) error {
+	err := s.Db.UpdateAlias(db.Alias{
 		Email: *s.From,
 		Alias: body,
 	})
+	if err != nil {
+		return err
+	}
+	s.result("Alias "+*s.From, nil)
+
+	var expiresAt *time.Time
+	if expires != "" {
+		day, err := time.ParseInLocation(time.DateOnly, expires, time.Local)
+		if err != nil {
+			s.result("Alias until "+expires, ErrBadDate)
+			return nil
+		}
+		day = day.AddDate(0, 0, 1)
+		expiresAt = &day
+	}
 
+	addresses := []string{*s.From}
 	if delegateFrom != nil {
 		from := emailaddress.FindWithRFC5322([]byte(*delegateFrom), false)
 		for _, address := range from {
-			s.Db.UpdateAlias(db.Alias{
-				Email:          address.String(),
-				Alias:          body,
-				DelegatedEmail: s.From,
-			})
+			active, err := s.delegateTo(address.String(), body, expiresAt)
+			if err != nil {
+				return err
+			}
+			// Keys only for addresses which agreed to act for the sender
+			if active {
+				addresses = append(addresses, address.String())
+			}
 		}
 	}
 
+	return s.registerPgpKeys(keys, addresses)
+}
+
+// Let the address act for the sender, asking it to confirm first unless it
+// already does. Returns whether the delegation is active.
+func (s *Session) delegateTo(address, alias string, expiresAt *time.Time) (bool, error) {
+	delegation := db.Alias{
+		Email:          address,
+		Alias:          alias,
+		DelegatedEmail: s.From,
+		ExpiresAt:      expiresAt,
+	}
+	if !s.ConfirmDelegation || s.Sender == nil ||
+		strings.EqualFold(s.Db.GetDelegatedEmailFor(address), *s.From) {
+		err := s.Db.UpdateAlias(delegation)
+		if errors.Is(err, db.ErrDelegatedElsewhere) {
+			s.result("Alias "+address, err)
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		s.result("Alias "+address, nil)
+		return true, nil
+	}
+
+	token := make([]byte, 8)
+	_, err := rand.Read(token)
+	if err != nil {
+		return false, err
+	}
+	confirmToken := hex.EncodeToString(token)
+	delegation.ConfirmToken = &confirmToken
+	err = s.Db.UpdateAlias(delegation)
+	if errors.Is(err, db.ErrDelegatedElsewhere) {
+		s.result("Alias "+address, err)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.Outbox = append(s.Outbox, Outgoing{
+		To:      address,
+		Subject: "Confirm alias " + confirmToken,
+		Body: fmt.Sprintf(
+			"%s wants this address to send tooltracker commands on their behalf.\n\n"+
+				"Please reply to this e-mail (to %s) to confirm, or ignore it if not.\n",
+			*s.From, s.To),
+	})
+	s.result("Alias "+address+" (waiting for confirmation)", nil)
+	return false, nil
+}
+
+// The delegated address confirmed it can act for the delegate
+func (s *Session) processConfirmAlias(token string) error {
+	command := "Confirm alias " + token
+	delegation := s.Db.GetPendingDelegation(token)
+	if delegation == nil {
+		s.result(command, ErrNoDelegation)
+		return nil
+	}
+	if !strings.EqualFold(delegation.Email, *s.From) {
+		s.result(command, ErrWrongDelegate)
+		return nil
+	}
+	err := s.Db.ConfirmDelegation(token)
+	if err != nil {
+		return err
+	}
+	s.result("Confirm alias "+delegation.Email+" for "+*delegation.DelegatedEmail, nil)
+	return nil
+}
+
+// Stop the address acting for the sender (or who the sender acts for)
+func (s *Session) processUnalias(address string) error {
+	address = strings.TrimSpace(address)
+	command := "Unalias " + address
+	revoked, err := s.Db.RevokeDelegation(address, &s.delegate)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		s.result(command, ErrNoDelegation)
+		return nil
+	}
+	s.result(command, nil)
 	return nil
 }
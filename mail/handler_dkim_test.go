@@ -70,9 +70,9 @@ func TestSigned(t *testing.T) {
 	s.From = &User1
 	msg, err := newSigned(Domain1, "valid", User1, To, Borrow+Tool1, "")
 	Assert(t, err)
-	Assert(t, s.Handle(msg))
+	Assert(t, s.Handle(msg).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	expected := []db.Item{
 		{
 			Location: db.Location{
@@ -89,12 +89,12 @@ func TestNotSigned(t *testing.T) {
 	defer conn.Close()
 
 	s.From = &User1
-	err := s.Handle(newPlain(User1, To, Borrow+Tool1, ""))
+	err := s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	AssertSlicesEqual(t, nil, items)
 }
 
@@ -103,9 +103,9 @@ func TestLocalNotSigned(t *testing.T) {
 	defer conn.Close()
 
 	s.From = &User1
-	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")))
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	expected := []db.Item{
 		{
 			Location: db.Location{
@@ -124,12 +124,12 @@ func TestNoKey(t *testing.T) {
 	s.From = &User1
 	msg, err := newSigned(Domain1, "revoked", User1, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
+	err = s.Handle(msg).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	AssertSlicesEqual(t, nil, items)
 }
 
@@ -140,12 +140,19 @@ func TestBadDomain(t *testing.T) {
 	s.From = &User3
 	msg, err := newSigned(Domain2, "valid", User3, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
-	if err != ErrInvalid {
-		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
+	outcome := s.Handle(msg)
+	if outcome.Err != ErrInvalid {
+		t.Fatalf("Expected %v, got %v", ErrInvalid, outcome.Err)
+	}
+	if outcome.Rejection != RejectNotVerified || outcome.Command != "borrow" {
+		t.Errorf("Expected unverified borrow, got %v %q", outcome.Rejection, outcome.Command)
+	}
+	// Signed, just not by the domain we want
+	if len(outcome.Verifications) != 1 || outcome.Verifications[0].Domain != Domain2 {
+		t.Errorf("Expected a verification for %s, got %s", Domain2, outcome.VerificationSummary())
 	}
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	AssertSlicesEqual(t, nil, items)
 }
 
@@ -158,9 +165,9 @@ func TestDelegate(t *testing.T) {
 	userAlias := "User alias"
 	msg, err := newSigned(Domain1, "valid", User1, To, Alias+User3, userAlias)
 	Assert(t, err)
-	Assert(t, s.Handle(msg))
+	Assert(t, s.Handle(msg).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	AssertSlicesEqual(t, nil, items)
 	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User1 {
 		t.Fatalf("Expecting delegate for %s To be %s, got %s", User3, User1, delegate)
@@ -170,9 +177,9 @@ func TestDelegate(t *testing.T) {
 	s.From = &User3
 	msg, err = newSigned(Domain2, "valid", User3, To, Borrow+Tool1, "")
 	Assert(t, err)
-	Assert(t, s.Handle(msg))
+	Assert(t, s.Handle(msg).Err)
 
-	items = conn.GetItems(nil)
+	items = itemsByName(conn)
 	expected := []db.Item{
 		{
 			Location: db.Location{
@@ -188,14 +195,14 @@ func TestDelegate(t *testing.T) {
 	s.From = &User4
 	msg, err = newSigned(Domain2, "valid", User4, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
+	err = s.Handle(msg).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
 	s.From = &User5
 	msg, err = newSigned(Domain3, "valid", User5, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
+	err = s.Handle(msg).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
@@ -210,9 +217,9 @@ func TestNoDelegate(t *testing.T) {
 	userAlias := "User alias"
 	msg, err := newSigned(Domain1, "valid", User1, To, Alias+User3, userAlias)
 	Assert(t, err)
-	Assert(t, s.Handle(msg))
+	Assert(t, s.Handle(msg).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	AssertSlicesEqual(t, nil, items)
 	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User1 {
 		t.Fatalf("Expecting delegate for %s To be %s, got %s", User3, User1, delegate)
@@ -222,26 +229,26 @@ func TestNoDelegate(t *testing.T) {
 	s.From = &User3
 	msg, err = newSigned(Domain2, "valid", User3, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
+	err = s.Handle(msg).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
 
-	items = conn.GetItems(nil)
+	items = itemsByName(conn)
 	AssertSlicesEqual(t, nil, items)
 
 	// Test that other users and domains still not valid
 	s.From = &User4
 	msg, err = newSigned(Domain2, "valid", User4, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
+	err = s.Handle(msg).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
 	s.From = &User5
 	msg, err = newSigned(Domain3, "valid", User5, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
+	err = s.Handle(msg).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
@@ -255,9 +262,9 @@ func TestNoUnsignedDelegate(t *testing.T) {
 	s.From = &User1
 	userAlias := "User alias"
 
-	Assert(t, s.Handle(newPlain(User1, To, Alias+User3, userAlias)))
+	Assert(t, s.Handle(newPlain(User1, To, Alias+User3, userAlias)).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	AssertSlicesEqual(t, nil, items)
 	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User1 {
 		t.Fatalf("Expecting delegate for %s To be %s, got %s", User3, User1, delegate)
@@ -267,16 +274,16 @@ func TestNoUnsignedDelegate(t *testing.T) {
 	s.From = &User3
 	msg, err := newSigned(Domain2, "valid", User3, To, Borrow+Tool1, "")
 	Assert(t, err)
-	Assert(t, s.Handle(msg))
+	Assert(t, s.Handle(msg).Err)
 
 	// Use plain user@domain
 	s.From = &User3
-	err = s.Handle(newPlain(User3, To, Borrow+Tool1, ""))
+	err = s.Handle(newPlain(User3, To, Borrow+Tool1, "")).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
 
-	items = conn.GetItems(nil)
+	items = itemsByName(conn)
 	expected := []db.Item{
 		{
 			Location: db.Location{
@@ -292,15 +299,151 @@ func TestNoUnsignedDelegate(t *testing.T) {
 	s.From = &User4
 	msg, err = newSigned(Domain2, "valid", User4, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
+	err = s.Handle(msg).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
 	s.From = &User5
 	msg, err = newSigned(Domain3, "valid", User5, To, Borrow+Tool1, "")
 	Assert(t, err)
-	err = s.Handle(msg)
+	err = s.Handle(msg).Err
 	if err != ErrInvalid {
 		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
 	}
 }
+
+func TestNotSignedDescribe(t *testing.T) {
+	conn, s := setup(t, Domain1, true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	err := s.Handle(newPlain(User1, To, "Describe "+Tool1, "Some description")).Err
+	if err != ErrInvalid {
+		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
+	}
+
+	if tool := conn.GetToolByName(Tool1); tool.Name != "" {
+		t.Fatalf("Expected no tool, got %v", tool)
+	}
+}
+
+// Send the signed mail from User1, the body has to differ for repeated
+// subjects so that they aren't duplicates
+func handleSigned(t *testing.T, s *Session, subject, body string) Outcome {
+	s.From = &User1
+	s.Report = nil
+	s.Outbox = nil
+	msg, err := newSigned(Domain1, "valid", User1, To, subject, body)
+	Assert(t, err)
+	return s.Handle(msg)
+}
+
+func TestDelegateConfirm(t *testing.T) {
+	conn, s := setup(t, Domain1, true, true)
+	defer conn.Close()
+
+	sender := &fakeSender{}
+	s.Sender = sender
+	s.ConfirmDelegation = true
+
+	Assert(t, handleSigned(t, &s, Alias+User3, "User alias").Err)
+	if len(sender.sent) != 1 || sender.sent[0].To != User3 {
+		t.Fatalf("Expected one confirmation to %s, got %v", User3, sender.sent)
+	}
+	subject := sender.sent[0].Subject
+	s.Outbox = nil
+
+	// Not confirmed yet
+	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User3 {
+		t.Fatalf("Expecting no delegate for %s, got %s", User3, delegate)
+	}
+	s.From = &User3
+	msg, err := newSigned(Domain2, "valid", User3, To, Borrow+Tool1, "")
+	Assert(t, err)
+	if err := s.Handle(msg).Err; err != ErrInvalid {
+		t.Fatalf("Expected %v, got %v", ErrInvalid, err)
+	}
+
+	// Only the delegated address can confirm
+	s.Report = nil
+	s.From = &User4
+	Assert(t, s.Handle(newPlain(User4, To, "Re: "+subject, "")).Err)
+	if len(s.Report) != 1 || s.Report[0].Err != ErrWrongDelegate {
+		t.Fatalf("Expected wrong delegate, got %s", s.Report)
+	}
+
+	s.From = &User3
+	Assert(t, s.Handle(newPlain(User3, To, "Re: "+subject, "")).Err)
+	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User1 {
+		t.Fatalf("Expecting delegate for %s To be %s, got %s", User3, User1, delegate)
+	}
+
+	// Already confirmed, e.g. when changing the alias
+	Assert(t, handleSigned(t, &s, Alias+User3, "New alias").Err)
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected no new confirmation, got %v", sender.sent[1:])
+	}
+	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User1 {
+		t.Fatalf("Expecting delegate for %s To be %s, got %s", User3, User1, delegate)
+	}
+}
+
+func TestDelegateExpiry(t *testing.T) {
+	conn, s := setup(t, Domain1, true, true)
+	defer conn.Close()
+
+	Assert(t, handleSigned(t, &s, Alias+User3+" until 2000-01-01", "Expired").Err)
+	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User3 {
+		t.Fatalf("Expecting expired delegate for %s, got %s", User3, delegate)
+	}
+
+	Assert(t, handleSigned(t, &s, Alias+User3+" until 2999-12-31", "Not expired").Err)
+	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User1 {
+		t.Fatalf("Expecting delegate for %s To be %s, got %s", User3, User1, delegate)
+	}
+
+	Assert(t, handleSigned(t, &s, Alias+User3+" until 2024-13-01", "Bad date").Err)
+	if last := s.Report[len(s.Report)-1]; last.Err != ErrBadDate {
+		t.Fatalf("Expected %v, got %s", ErrBadDate, s.Report)
+	}
+}
+
+func TestDelegateElsewhere(t *testing.T) {
+	conn, s := setup(t, Domain1, true, true)
+	defer conn.Close()
+
+	Assert(t, handleSigned(t, &s, Alias+User3+" until 2000-01-01", "Expired").Err)
+	Assert(t, handleSigned(t, &s, Alias+User4, "User alias").Err)
+
+	// Someone else can't take over an active delegation, only an expired one
+	s.From = &User2
+	s.Report = nil
+	msg, err := newSigned(Domain1, "valid", User2, To, Alias+User3+", "+User4, "Other alias")
+	Assert(t, err)
+	Assert(t, s.Handle(msg).Err)
+	if len(s.Report) != 3 || s.Report[1].Err != nil || s.Report[2].Err != db.ErrDelegatedElsewhere {
+		t.Fatalf("Expected %v for %s, got %s", db.ErrDelegatedElsewhere, User4, s.Report)
+	}
+	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User2 {
+		t.Errorf("Expecting delegate for %s to be %s, got %s", User3, User2, delegate)
+	}
+	if delegate := conn.GetDelegatedEmailFor(User4); delegate != User1 {
+		t.Errorf("Expecting delegate for %s to be %s, got %s", User4, User1, delegate)
+	}
+}
+
+func TestUnalias(t *testing.T) {
+	conn, s := setup(t, Domain1, true, true)
+	defer conn.Close()
+
+	Assert(t, handleSigned(t, &s, Alias+User3, "User alias").Err)
+	Assert(t, handleSigned(t, &s, "Unalias "+User3, "").Err)
+	if delegate := conn.GetDelegatedEmailFor(User3); delegate != User3 {
+		t.Fatalf("Expecting no delegate for %s, got %s", User3, delegate)
+	}
+
+	Assert(t, handleSigned(t, &s, "Unalias "+User3, "Again").Err)
+	if len(s.Report) != 1 || s.Report[0].Err != ErrNoDelegation {
+		t.Fatalf("Expected no delegation, got %s", s.Report)
+	}
+}
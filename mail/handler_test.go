@@ -1,11 +1,17 @@
 package mail
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/KoviRobi/tooltracker/db"
+	"github.com/KoviRobi/tooltracker/ratelimit"
+	"github.com/KoviRobi/tooltracker/tags"
 	. "github.com/KoviRobi/tooltracker/test_utils"
 )
 
@@ -26,14 +32,26 @@ func setup(t *testing.T, dkim string, delegate, localDkim bool) (db.DB, Session)
 	return conn, s
 }
 
+// The items by name, with the tool's name in place of its (random) ID, to
+// compare
+func itemsByName(conn db.DB) []db.Item {
+	items := conn.GetItems(nil)
+	for i := range items {
+		items[i].Tool = items[i].Name
+		items[i].Name = ""
+	}
+	slices.SortFunc(items, func(a, b db.Item) int { return strings.Compare(a.Tool, b.Tool) })
+	return items
+}
+
 func TestBorrowed(t *testing.T) {
 	conn, s := setup(t, "", true, true)
 	defer conn.Close()
 
 	s.From = &User1
-	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")))
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	expected := []db.Item{
 		{
 			Location: db.Location{
@@ -51,9 +69,9 @@ func TestBorrowedPlain(t *testing.T) {
 
 	s.From = &User1
 	comment := "Some comment"
-	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, comment)))
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, comment)).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	expected := []db.Item{
 		{
 			Location: db.Location{
@@ -87,9 +105,9 @@ Content-Type: text/html; charset="utf-8"
 	</body>
 </html>
 `, User1, To, Tool1, comment)
-	Assert(t, s.Handle([]byte(eml)))
+	Assert(t, s.Handle([]byte(eml)).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	expected := []db.Item{
 		{
 			Location: db.Location{
@@ -107,12 +125,12 @@ func TestBorrowedUpdate(t *testing.T) {
 	defer conn.Close()
 
 	s.From = &User1
-	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")))
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
 
 	s.From = &User2
-	Assert(t, s.Handle(newPlain(User2, To, Borrow+Tool1, "")))
+	Assert(t, s.Handle(newPlain(User2, To, Borrow+Tool1, "")).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	expected := []db.Item{
 		{
 			Location: db.Location{
@@ -129,12 +147,12 @@ func TestBorrowedMultiple(t *testing.T) {
 	defer conn.Close()
 
 	s.From = &User1
-	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")))
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
 
 	s.From = &User2
-	Assert(t, s.Handle(newPlain(User2, To, Borrow+Tool2, "")))
+	Assert(t, s.Handle(newPlain(User2, To, Borrow+Tool2, "")).Err)
 
-	items := conn.GetItems(nil)
+	items := itemsByName(conn)
 	expected1 := db.Item{
 		Location: db.Location{
 			Tool:       Tool1,
@@ -156,3 +174,435 @@ func TestBorrowedMultiple(t *testing.T) {
 		t.Fatalf("Expected %v, got %v\n", expected, got)
 	}
 }
+
+func TestBorrowedBatchSubject(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1+", "+Tool2, "")).Err)
+
+	items := itemsByName(conn)
+	expected := []db.Item{
+		{Location: db.Location{Tool: Tool1, LastSeenBy: User1}},
+		{Location: db.Location{Tool: Tool2, LastSeenBy: User1}},
+	}
+	AssertSlicesEqual(t, expected, items)
+}
+
+func TestOutcome(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	outcome := s.Handle(newPlain(User1, To, Borrow+Tool1+", "+Tool2, ""))
+	Assert(t, outcome.Err)
+	if outcome.Command != "borrow" || outcome.Sender != User1 || outcome.Rejection != NotRejected {
+		t.Errorf("Unexpected outcome %+v", outcome)
+	}
+	if !slices.Equal(outcome.Tools, []string{Tool1, Tool2}) {
+		t.Errorf("Expected tools %q, got %q", []string{Tool1, Tool2}, outcome.Tools)
+	}
+
+	outcome = s.Handle(newPlain(User1, To, "Lent "+Tool1, ""))
+	if outcome.Err != ErrInvalid || outcome.Rejection != RejectBadCommand {
+		t.Errorf("Expected bad command, got %+v", outcome)
+	}
+}
+
+func TestBatchBody(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	body := strings.Join([]string{
+		Borrow + Tool1,
+		"Returned " + Tool2,
+		"Frobnicate " + Tool1,
+		"Tag " + Tool1 + " +lab2",
+	}, "\n")
+	Assert(t, s.Handle(newPlain(User1, To, "Batch", body)).Err)
+
+	returned := returnedComment
+	items := itemsByName(conn)
+	expected := []db.Item{
+		{
+			Location: db.Location{Tool: Tool1, LastSeenBy: User1},
+			Tags:     &[]string{"lab2"},
+		},
+		{Location: db.Location{Tool: Tool2, LastSeenBy: User1, Comment: &returned}},
+	}
+	AssertSlicesEqual(t, expected, items)
+
+	expectedReport := Report{
+		{Command: Borrow + Tool1},
+		{Command: "Returned " + Tool2},
+		{Command: "Frobnicate " + Tool1, Err: ErrBadCommand},
+		{Command: "Tag " + Tool1 + " +lab2"},
+	}
+	if !reflect.DeepEqual(expectedReport, s.Report) {
+		t.Fatalf("Expected report:\n%sGot:\n%s", expectedReport, s.Report)
+	}
+}
+
+func TestDescribeAndTag(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	description := "Some description"
+	Assert(t, s.Handle(newPlain(User1, To, "Describe "+Tool1, description)).Err)
+	Assert(t, s.Handle(newPlain(User1, To, "Tag "+Tool1+" +lab1 +lab2", "")).Err)
+	Assert(t, s.Handle(newPlain(User1, To, "Tag "+Tool1+" -lab1", "")).Err)
+
+	tool := conn.GetToolByName(Tool1)
+	expected := []db.Tool{
+		{
+			Id:          tool.Id,
+			Name:        Tool1,
+			Description: &description,
+			Tags:        tags.Tags{"lab2": tags.Any},
+		},
+	}
+	AssertSlicesEqual(t, expected, []db.Tool{tool})
+}
+
+func TestPhoto(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	image := []byte("\x89PNG not really")
+	eml := fmt.Sprintf(`From: %s
+To: %s
+Subject: Photo %s
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="boundary"
+
+--boundary
+Content-Type: text/plain
+
+--boundary
+Content-Type: image/png
+Content-Disposition: attachment; filename="tool.png"
+Content-Transfer-Encoding: base64
+
+%s
+--boundary--
+`, User1, To, Tool1, base64.StdEncoding.EncodeToString(image))
+	Assert(t, s.Handle([]byte(eml)).Err)
+
+	tool := conn.GetToolByName(Tool1)
+	if tool.Image != base64.StdEncoding.EncodeToString(image) {
+		t.Fatalf("Expected image %q, got %q", image, tool.Image)
+	}
+
+	s.Report = nil
+	Assert(t, s.Handle(newPlain(User1, To, "Photo "+Tool1, "")).Err)
+	expectedReport := Report{{Command: "Photo " + Tool1, Err: ErrNoImage}}
+	if !reflect.DeepEqual(expectedReport, s.Report) {
+		t.Fatalf("Expected report:\n%sGot:\n%s", expectedReport, s.Report)
+	}
+}
+
+type fakeSender struct{ sent []Outgoing }
+
+func (f *fakeSender) Send(out Outgoing) error {
+	f.sent = append(f.sent, out)
+	return nil
+}
+
+func TestGave(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	userAlias := "User Two"
+	s.From = &User2
+	Assert(t, s.Handle(newPlain(User2, To, Alias, userAlias)).Err)
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, "Gave "+Tool1+" to user two", "")).Err)
+
+	comment := "Given by " + User1
+	items := itemsByName(conn)
+	expected := []db.Item{
+		{
+			Location: db.Location{
+				Tool:       Tool1,
+				LastSeenBy: User2,
+				Comment:    &comment,
+			},
+			Alias: &userAlias,
+		},
+	}
+	AssertSlicesEqual(t, expected, items)
+
+	s.Report = nil
+	Assert(t, s.Handle(newPlain(User1, To, "Gave "+Tool1+" to nobody", "")).Err)
+	expectedReport := Report{{Command: "Gave " + Tool1 + " to nobody", Err: ErrNoRecipient}}
+	if !reflect.DeepEqual(expectedReport, s.Report) {
+		t.Fatalf("Expected report:\n%sGot:\n%s", expectedReport, s.Report)
+	}
+}
+
+func TestGaveConfirm(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	sender := &fakeSender{}
+	s.Sender = sender
+	s.ConfirmHandover = true
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
+	s.Outbox = nil
+	Assert(t, s.Handle(newPlain(User1, To, "Gave "+Tool1+" to "+User2, "")).Err)
+
+	if len(sender.sent) != 1 || sender.sent[0].To != User2 {
+		t.Fatalf("Expected one confirmation to %s, got %v", User2, sender.sent)
+	}
+	subject := sender.sent[0].Subject
+
+	// Not confirmed yet
+	items := itemsByName(conn)
+	expected := []db.Item{{Location: db.Location{Tool: Tool1, LastSeenBy: User1}}}
+	AssertSlicesEqual(t, expected, items)
+
+	// Only the recipient can confirm
+	s.Report = nil
+	s.From = &User3
+	Assert(t, s.Handle(newPlain(User3, To, "Re: "+subject, "")).Err)
+	if len(s.Report) != 1 || s.Report[0].Err != ErrWrongRecipient {
+		t.Fatalf("Expected wrong recipient, got %s", s.Report)
+	}
+
+	s.From = &User2
+	Assert(t, s.Handle(newPlain(User2, To, "Re: "+subject, "")).Err)
+
+	comment := "Given by " + User1
+	items = itemsByName(conn)
+	expected = []db.Item{
+		{Location: db.Location{Tool: Tool1, LastSeenBy: User2, Comment: &comment}},
+	}
+	AssertSlicesEqual(t, expected, items)
+}
+
+func TestRateLimit(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.Limits = ratelimit.Limits{
+		Sender:   ratelimit.New(1, 3),
+		Tool:     ratelimit.New(1, 2),
+		NewTools: ratelimit.NewDailyCap(1),
+	}
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1+", "+Tool2, "")).Err)
+	expectedReport := Report{
+		{Command: "Borrowed " + Tool1},
+		{Command: "Borrowed " + Tool2, Err: ErrTooManyTools},
+	}
+	if !reflect.DeepEqual(expectedReport, s.Report) {
+		t.Fatalf("Expected report:\n%sGot:\n%s", expectedReport, s.Report)
+	}
+
+	s.Report = nil
+	Assert(t, s.Handle(newPlain(User1, To, "Returned "+Tool1, "")).Err)
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
+	expectedReport = Report{
+		{Command: "Returned " + Tool1},
+		{Command: "Borrowed " + Tool1, Err: ErrToolRateLimited},
+	}
+	if !reflect.DeepEqual(expectedReport, s.Report) {
+		t.Fatalf("Expected report:\n%sGot:\n%s", expectedReport, s.Report)
+	}
+
+	outcome := s.Handle(newPlain(User1, To, "Returned "+Tool1, ""))
+	if outcome.Err != ErrInvalid || outcome.Rejection != RejectRateLimited {
+		t.Fatalf("Expected rate limited, got %v %v", outcome.Err, outcome.Rejection)
+	}
+	// Unverified commands don't use up the sender's allowance, as anyone
+	// could send them
+	s.From = &User2
+	for range 4 {
+		Assert(t, s.Handle(newPlain(User2, To, "Confirm alias 0123456789abcdef", "")).Err)
+	}
+	// Other senders aren't limited, but the new tools are for everyone
+	s.Report = nil
+	Assert(t, s.Handle(newPlain(User2, To, "Describe "+Tool2, "")).Err)
+	if len(s.Report) != 1 || s.Report[0].Err != ErrTooManyTools {
+		t.Fatalf("Expected too many tools, got %s", s.Report)
+	}
+
+	if stats := s.Limits.Stats(); stats != (ratelimit.Stats{Sender: 1, Tool: 1, NewTools: 2}) {
+		t.Errorf("Unexpected rejection counts %+v", stats)
+	}
+}
+
+func TestToolNames(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.ToolAutocorrect = 1
+	s.ToolSuggest = 3
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+"Scope 3, Soldering iron", "")).Err)
+	Assert(t, s.Handle(newPlain(User1, To, "Returned scope-3", "")).Err)
+	Assert(t, s.Handle(newPlain(User1, To, "Returned  soldering irn ", "")).Err)
+	s.Report = nil
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+"soldring irn, scope 4", "")).Err)
+
+	if len(s.Report) != 2 || !errors.Is(s.Report[0].Err, ErrUnknownTool) ||
+		!strings.Contains(s.Report[0].Err.Error(), `"Soldering iron"`) ||
+		s.Report[1].Err != nil {
+		t.Fatalf("Expected a suggestion then a new tool, got %s", s.Report)
+	}
+
+	comment := returnedComment
+	expected := []db.Item{
+		{Location: db.Location{Tool: "Scope 3", LastSeenBy: User1, Comment: &comment}},
+		{Location: db.Location{Tool: "Soldering iron", LastSeenBy: User1, Comment: &comment}},
+		{Location: db.Location{Tool: "scope 4", LastSeenBy: User1}},
+	}
+	AssertSlicesEqual(t, expected, itemsByName(conn))
+
+	// Only one edit, but a different word, so likely a different tool
+	s.Report = nil
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+"Probe A", "")).Err)
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+"probe b", "")).Err)
+	if len(s.Report) != 2 || s.Report[0].Err != nil || !errors.Is(s.Report[1].Err, ErrUnknownTool) ||
+		!strings.Contains(s.Report[1].Err.Error(), `"Probe A"`) {
+		t.Fatalf("Expected a suggestion rather than a correction, got %s", s.Report)
+	}
+}
+
+func TestToolNameSymbols(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+"C++, C#, C", "")).Err)
+	Assert(t, s.Handle(newPlain(User1, To, "Returned c++", "")).Err)
+	s.Report = nil
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+"--", "")).Err)
+	if len(s.Report) != 1 || s.Report[0].Err != ErrNoTool {
+		t.Fatalf("Expected %v, got %s", ErrNoTool, s.Report)
+	}
+
+	comment := returnedComment
+	expected := []db.Item{
+		{Location: db.Location{Tool: "C", LastSeenBy: User1}},
+		{Location: db.Location{Tool: "C#", LastSeenBy: User1}},
+		{Location: db.Location{Tool: "C++", LastSeenBy: User1, Comment: &comment}},
+	}
+	AssertSlicesEqual(t, expected, itemsByName(conn))
+}
+
+func TestRenamedTool(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
+	_, err := conn.RenameTool(conn.GetToolByName(Tool1).Id, Tool2)
+	Assert(t, err)
+
+	// E.g. from the old QR code
+	s.From = &User2
+	Assert(t, s.Handle(newPlain(User2, To, Borrow+Tool1, "")).Err)
+
+	expected := []db.Item{{Location: db.Location{Tool: Tool2, LastSeenBy: User2}}}
+	AssertSlicesEqual(t, expected, itemsByName(conn))
+
+	// A QR code has the ID, which doesn't change
+	s.From = &User1
+	id := conn.GetToolByName(Tool2).Id
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+strings.ToUpper(id), "")).Err)
+
+	expected = []db.Item{{Location: db.Location{Tool: Tool2, LastSeenBy: User1}}}
+	AssertSlicesEqual(t, expected, itemsByName(conn))
+}
+
+func TestToolNamedLikeId(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
+	id := conn.GetToolByName(Tool1).Id
+	// E.g. added on the web
+	_, err := conn.AddTool(id)
+	Assert(t, err)
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+id, "")).Err)
+
+	// The name wins, unless it is a QR code
+	s.From = &User2
+	Assert(t, s.Handle(newPlain(User2, To, "Returned "+id, "")).Err)
+	s.QrKey = []byte("secret")
+	Assert(t, s.Handle(newPlain(User2, To, Borrow+WithQrToken(s.QrKey, id), "")).Err)
+
+	comment := returnedComment
+	expected := []db.Item{
+		{Location: db.Location{Tool: id, LastSeenBy: User2, Comment: &comment}},
+		{Location: db.Location{Tool: Tool1, LastSeenBy: User2}},
+	}
+	AssertSlicesEqual(t, expected, itemsByName(conn))
+}
+
+func TestDuplicate(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	borrowed := []byte("Message-ID: <1@example.com>\n" + string(newPlain(User1, To, Borrow+Tool1, "")))
+	returned := []byte("Message-ID: <2@example.com>\n" + string(newPlain(User1, To, "Returned "+Tool1, "")))
+
+	s.From = &User1
+	Assert(t, s.Handle(borrowed).Err)
+	Assert(t, s.Handle(returned).Err)
+	// Redelivered, e.g. after a crash before the IMAP delete
+	Assert(t, s.Handle(borrowed).Err)
+
+	items := itemsByName(conn)
+	comment := returnedComment
+	expected := []db.Item{
+		{
+			Location: db.Location{
+				Tool:       Tool1,
+				LastSeenBy: User1,
+				Comment:    &comment,
+			},
+		},
+	}
+	AssertSlicesEqual(t, expected, items)
+}
+
+func TestOutOfOrder(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	later := []byte("Date: Tue, 02 Jan 2024 10:00:00 +0000\n" + string(newPlain(User2, To, Borrow+Tool1, "")))
+	earlier := []byte("Date: Mon, 01 Jan 2024 10:00:00 +0000\n" + string(newPlain(User1, To, Borrow+Tool1, "")))
+
+	s.From = &User2
+	Assert(t, s.Handle(later).Err)
+	// Delayed mail, sent before the other one
+	s.From = &User1
+	Assert(t, s.Handle(earlier).Err)
+
+	if last := s.Report[len(s.Report)-1]; !errors.Is(last.Err, db.ErrOutdated) {
+		t.Errorf("Expected outdated report, got %s", s.Report)
+	}
+
+	items := itemsByName(conn)
+	expected := []db.Item{
+		{
+			Location: db.Location{
+				Tool:       Tool1,
+				LastSeenBy: User2,
+			},
+		},
+	}
+	AssertSlicesEqual(t, expected, items)
+}
@@ -0,0 +1,81 @@
+package mail
+
+import (
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Translations of the commands, e.g. "Kölcsönvettem" for "Borrowed". Set from
+// the config file, see SetLanguages.
+type Language struct {
+	// Reply/forward prefixes, e.g. "AW" for "Antwort", without the colon
+	Prefixes []string
+	// Command names (see Command.Name) and Words to their translations
+	Keywords map[string][]string
+}
+
+var languages map[string]Language
+
+// Reply/forward prefixes stripped from the subject in any language
+var defaultPrefixes = []string{"Re", "Fw", "Fwd", "AW", "WG", "SV", "VS", "Vá", "Tr"}
+
+var prefixRe = buildPrefixRe()
+
+// Set the languages, all of them are accepted in every mail (people don't
+// necessarily use the language of the QR code)
+func SetLanguages(langs map[string]Language) {
+	languages = langs
+	prefixRe = buildPrefixRe()
+	for _, command := range commands {
+		command.compile()
+	}
+}
+
+// The names of the configured languages, sorted
+func LanguageNames() []string {
+	var names []string
+	for name := range languages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// All the translations for a command or word, in a stable order
+func translations(name string) []string {
+	var ret []string
+	for _, language := range LanguageNames() {
+		ret = append(ret, languages[language].Keywords[name]...)
+	}
+	return ret
+}
+
+func buildPrefixRe() *regexp.Regexp {
+	prefixes := slices.Clone(defaultPrefixes)
+	for _, language := range languages {
+		prefixes = append(prefixes, language.Prefixes...)
+	}
+	// Any number of e.g. "Re: AW: Re[2]: "
+	return regexp.MustCompile(`^(?i)(` + alternatives(prefixes) + `(\[\d+\])?\s*[:：]\s*)*`)
+}
+
+// Remove "Re:", "AW:" and similar from the start of the subject
+func stripReplyPrefixes(subject string) string {
+	return prefixRe.ReplaceAllString(strings.TrimSpace(subject), "")
+}
+
+// The keyword for a command in the given language, e.g. for the QR code.
+// Falls back to English.
+func Keyword(name, language string) string {
+	if keywords := languages[language].Keywords[name]; len(keywords) > 0 {
+		return keywords[0]
+	}
+	for _, command := range commands {
+		if command.Name == name {
+			return command.keyword()
+		}
+	}
+	return name
+}
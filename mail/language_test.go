@@ -0,0 +1,63 @@
+package mail
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/KoviRobi/tooltracker/db"
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+func TestLanguages(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	SetLanguages(map[string]Language{
+		"hu": {
+			Prefixes: []string{"Vá"},
+			Keywords: map[string][]string{"borrow": {"Kölcsönvettem"}},
+		},
+		"fr": {
+			Prefixes: []string{"Réf"},
+			Keywords: map[string][]string{"borrow": {"Emprunté"}, "gave": {"Donné"}, "to": {"à"}},
+		},
+	})
+	defer SetLanguages(nil)
+
+	if keyword := Keyword("borrow", "hu"); keyword != "Kölcsönvettem" {
+		t.Fatalf("Expected Kölcsönvettem, got %s", keyword)
+	}
+	if keyword := Keyword("borrow", "de"); keyword != "Borrowed" {
+		t.Fatalf("Expected Borrowed, got %s", keyword)
+	}
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, "Vá: kölcsönvettem "+Tool1, "")).Err)
+	Assert(t, s.Handle(newPlain(User1, To, "Réf : Emprunté "+Tool2, "")).Err)
+	Assert(t, s.Handle(newPlain(User1, To, "Donné "+Tool2+" à "+User2, "")).Err)
+
+	comment := "Given by " + User1
+	items := itemsByName(conn)
+	toolCmp := func(a, b db.Item) int { return strings.Compare(a.Tool, b.Tool) }
+	slices.SortFunc(items, toolCmp)
+	expected := []db.Item{
+		{Location: db.Location{Tool: Tool1, LastSeenBy: User1}},
+		{Location: db.Location{Tool: Tool2, LastSeenBy: User2, Comment: &comment}},
+	}
+	AssertSlicesEqual(t, expected, items)
+}
+
+func TestReplyPrefixes(t *testing.T) {
+	for subject, expected := range map[string]string{
+		"Re: Alias":          "Alias",
+		"AW: Re[2]: SV:Help": "Help",
+		"Vá: Alias x":        "Alias x",
+		"Borrowed Re: x":     "Borrowed Re: x",
+		"Reborrowed x":       "Reborrowed x",
+	} {
+		if got := stripReplyPrefixes(subject); got != expected {
+			t.Fatalf("Expected %q, got %q", expected, got)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/mnako/letters"
+
+	"github.com/KoviRobi/tooltracker/db"
+)
+
+// Users outside the --dkim domain can register an OpenPGP key (through the web
+// UI, or a work account's Alias mail), then commands signed with it (PGP/MIME
+// or inline clearsigned) are accepted without DKIM. The address has to confirm
+// the key first, see RequestPgpKey. The command has to be signed too, as
+// protected headers in PGP/MIME, or as the first line of the clearsigned text,
+// otherwise a signed mail could be resent with another subject.
+
+var ErrPgpKey = errors.New("Expected one OpenPGP public key")
+var ErrPgpNoUid = errors.New("OpenPGP key has no user ID for the address")
+var ErrPgpClearsigned = errors.New("Clearsigned message isn't the whole text")
+var ErrNoPgpKey = errors.New("No such OpenPGP key, perhaps already confirmed")
+var ErrWrongPgpKey = errors.New("OpenPGP key was for someone else")
+
+var pgpKeyBlockRe = regexp.MustCompile(
+	`(?s)-----BEGIN PGP PUBLIC KEY BLOCK-----.*?-----END PGP PUBLIC KEY BLOCK-----\r?\n?`)
+
+const clearsignStart = "-----BEGIN PGP SIGNED MESSAGE-----"
+
+// Check the ASCII armored key, returns its fingerprint and (lower case) e-mails
+func ParsePgpKey(armored string) (string, []string, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrPgpKey, err)
+	}
+	if len(entities) != 1 {
+		return "", nil, fmt.Errorf("%w, got %d", ErrPgpKey, len(entities))
+	}
+	var emails []string
+	for _, identity := range entities[0].Identities {
+		if identity.UserId.Email != "" {
+			emails = append(emails, strings.ToLower(identity.UserId.Email))
+		}
+	}
+	return fmt.Sprintf("%X", entities[0].PrimaryKey.Fingerprint), emails, nil
+}
+
+// The key for the e-mail, which needs a user ID for it
+func pgpKeyFor(email, armored, addedBy string) (db.PgpKey, error) {
+	fingerprint, emails, err := ParsePgpKey(armored)
+	if err != nil {
+		return db.PgpKey{}, err
+	}
+	if !slices.Contains(emails, strings.ToLower(strings.TrimSpace(email))) {
+		return db.PgpKey{}, fmt.Errorf("%w %s", ErrPgpNoUid, email)
+	}
+	return db.PgpKey{
+		Email:       email,
+		Fingerprint: fingerprint,
+		Key:         armored,
+		AddedBy:     addedBy,
+	}, nil
+}
+
+// Ask the e-mail to confirm the key (by replying to a mail with a token),
+// before commands signed with it are accepted. Until then the current key, if
+// any, stays. For the web UI, so the mail is sent straight away. Returns the
+// fingerprint.
+func (s Session) RequestPgpKey(email, armored, addedBy string) (string, error) {
+	s.Outbox = nil
+	fingerprint, err := s.requestPgpKey(email, armored, addedBy)
+	if err != nil {
+		return "", err
+	}
+	s.sendOutbox()
+	return fingerprint, nil
+}
+
+func (s *Session) requestPgpKey(email, armored, addedBy string) (string, error) {
+	if s.Sender == nil {
+		return "", ErrNoSender
+	}
+	key, err := pgpKeyFor(email, armored, addedBy)
+	if err != nil {
+		return "", err
+	}
+	token := make([]byte, 8)
+	_, err = rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	confirmToken := hex.EncodeToString(token)
+	err = s.Db.AddPendingPgpKey(confirmToken, key)
+	if err != nil {
+		return "", err
+	}
+	s.Outbox = append(s.Outbox, Outgoing{
+		To:      email,
+		Subject: "Confirm key " + confirmToken,
+		Body: fmt.Sprintf(
+			"%s wants to register the OpenPGP key %s for this address, so that\n"+
+				"tooltracker commands signed with it are accepted.\n\n"+
+				"Please reply to this e-mail (to %s) to confirm, or ignore it if not.\n",
+			addedBy, key.Fingerprint, s.To),
+	})
+	return key.Fingerprint, nil
+}
+
+// The address confirmed the key is theirs
+func (s *Session) processConfirmPgpKey(token string) error {
+	command := "Confirm key " + token
+	key := s.Db.GetPendingPgpKey(token)
+	if key == nil {
+		s.result(command, ErrNoPgpKey)
+		return nil
+	}
+	if !strings.EqualFold(key.Email, *s.From) {
+		s.result(command, ErrWrongPgpKey)
+		return nil
+	}
+	err := s.Db.ConfirmPgpKey(token)
+	if err != nil {
+		return err
+	}
+	s.result("OpenPGP key "+key.Fingerprint+" for "+key.Email, nil)
+	return nil
+}
+
+// ASCII armored keys in the body or attached (e.g. "0x1234.asc")
+func pgpKeysIn(m *letters.Email) []string {
+	keys := pgpKeyBlockRe.FindAllString(m.Text, -1)
+	for _, file := range m.AttachedFiles {
+		keys = append(keys, pgpKeyBlockRe.FindAllString(string(file.Data), -1)...)
+	}
+	return keys
+}
+
+// Keep only the text of clearsigned messages, and drop keys, so that they
+// don't end up as comments or aliases
+func stripPgpArmor(text string) string {
+	if start := strings.Index(text, clearsignStart); start >= 0 {
+		if block, rest := clearsign.Decode([]byte(text[start:])); block != nil {
+			text = text[:start] + string(block.Plaintext) + "\n" + string(rest)
+		}
+	}
+	return pgpKeyBlockRe.ReplaceAllString(text, "")
+}
+
+// The signer, if the mail is PGP/MIME signed or has an inline clearsigned
+// body, with a key in the keyring, and the subject is signed too
+func verifyPgp(raw []byte, keyring openpgp.EntityList, subject string) (*openpgp.Entity, error) {
+	fields, body := splitMessage(raw)
+	signed, signature, err := splitSigned(fields, body, "application/pgp-signature")
+	if err == nil {
+		_, signature := splitMessage([]byte(signature))
+		signer, err := openpgp.CheckArmoredDetachedSignature(keyring,
+			strings.NewReader(signed), strings.NewReader(signature), nil)
+		if err != nil {
+			return nil, err
+		}
+		if !signsSubject(signed, subject) {
+			return nil, ErrUnsignedSubject
+		}
+		return signer, nil
+	} else if !errors.Is(err, ErrNotSigned) {
+		return nil, err
+	}
+
+	m, err := letters.ParseEmail(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(m.Text)
+	if !strings.Contains(text, clearsignStart) {
+		return nil, ErrNotSigned
+	}
+	// Not e.g. a quoted one, with unsigned text around it
+	if !strings.HasPrefix(text, clearsignStart) {
+		return nil, ErrPgpClearsigned
+	}
+	block, rest := clearsign.Decode([]byte(text))
+	if block == nil {
+		return nil, fmt.Errorf("%w: bad clearsigned message", ErrSignedStructure)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, ErrPgpClearsigned
+	}
+	signer, err := block.VerifySignature(keyring, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !clearsignsSubject(string(block.Plaintext), subject) {
+		return nil, ErrUnsignedSubject
+	}
+	return signer, nil
+}
+
+// The subject can't be in the headers of a clearsigned message, so it has to
+// be the first line, e.g. "Borrowed scope\nBy the bench". A batch (empty
+// subject) has all its commands in the signed text anyway.
+func clearsignsSubject(plaintext, subject string) bool {
+	if strings.TrimSpace(subject) == "" {
+		return true
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(plaintext), "\n")
+	return strings.TrimSpace(first) == strings.TrimSpace(subject)
+}
+
+// Whether the mail is signed with the sender's registered key
+func (s *Session) checkPgp(reader io.Reader) bool {
+	key := s.Db.GetPgpKey(*s.From)
+	if key == nil {
+		return false
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Key))
+	if err != nil {
+		log.Printf("OpenPGP: bad key for %s: %v", key.Email, err)
+		s.pgp = "fail: " + err.Error()
+		return false
+	}
+
+	var buf bytes.Buffer
+	buf.ReadFrom(reader)
+	_, err = verifyPgp(buf.Bytes(), keyring, s.subject)
+	if errors.Is(err, ErrNotSigned) {
+		s.pgp = "none"
+		return false
+	} else if err != nil {
+		log.Printf("OpenPGP: %v", err)
+		s.pgp = "fail: " + err.Error()
+		return false
+	}
+	s.pgp = "pass " + key.Fingerprint
+	return true
+}
+
+// Register the keys in the Alias mail for the addresses, the sender or the
+// ones it vouches for. The (verified) sender's own key is registered straight
+// away, the other addresses have to confirm theirs.
+func (s *Session) registerPgpKeys(keys []string, addresses []string) error {
+	for _, armored := range keys {
+		fingerprint, emails, err := ParsePgpKey(armored)
+		if err != nil {
+			s.result("OpenPGP key", err)
+			continue
+		}
+		command := "OpenPGP key " + fingerprint
+		registered := false
+		for _, address := range addresses {
+			if !slices.Contains(emails, strings.ToLower(address)) {
+				continue
+			}
+			registered = true
+			if strings.EqualFold(address, *s.From) {
+				key, err := pgpKeyFor(address, armored, *s.From)
+				if err != nil {
+					s.result(command+" for "+address, err)
+					continue
+				}
+				err = s.Db.UpdatePgpKey(key)
+				if err != nil {
+					return err
+				}
+				s.result(command+" for "+address, nil)
+				continue
+			}
+			_, err := s.requestPgpKey(address, armored, *s.From)
+			if errors.Is(err, ErrNoSender) {
+				s.result(command+" for "+address, err)
+				continue
+			} else if err != nil {
+				return err
+			}
+			s.result(command+" for "+address+" (waiting for confirmation)", nil)
+		}
+		if !registered {
+			s.result(command, ErrPgpNoUid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+
+	"github.com/KoviRobi/tooltracker/db"
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+var pgpConfig = &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+
+func newPgpEntity(t *testing.T, email string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Test user", "", email, pgpConfig)
+	Assert(t, err)
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	Assert(t, err)
+	Assert(t, entity.Serialize(w))
+	Assert(t, w.Close())
+	return entity, armored.String()
+}
+
+// A PGP/MIME (RFC 3156) signed mail, with the subject in protected headers as
+// e.g. Thunderbird sends
+func pgpMimeSigned(t *testing.T, entity *openpgp.Entity, from, subject, body string) string {
+	content := "Content-Type: text/plain; charset=utf-8; protected-headers=\"v1\"\r\n" +
+		"Subject: " + subject + "\r\n\r\n" + body + "\r\n"
+	return pgpMimeSign(t, entity, from, subject, content)
+}
+
+// A PGP/MIME signed mail of the content (with its MIME headers)
+func pgpMimeSign(t *testing.T, entity *openpgp.Entity, from, subject, content string) string {
+	var signature bytes.Buffer
+	Assert(t, openpgp.ArmoredDetachSign(&signature, entity, strings.NewReader(content), pgpConfig))
+
+	return fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/signed; micalg=pgp-sha256;\r\n"+
+		" protocol=\"application/pgp-signature\"; boundary=\"boundary\"\r\n"+
+		"\r\n"+
+		"--boundary\r\n"+
+		"%s\r\n"+
+		"--boundary\r\n"+
+		"Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n"+
+		"\r\n"+
+		"%s\r\n"+
+		"--boundary--\r\n",
+		from, To, subject, content, signature.String())
+}
+
+// The text clearsigned, with the command (the subject) as the first line
+func clearsignText(t *testing.T, entity *openpgp.Entity, text string) string {
+	var signed bytes.Buffer
+	w, err := clearsign.Encode(&signed, entity.PrivateKey, pgpConfig)
+	Assert(t, err)
+	_, err = w.Write([]byte(text + "\n"))
+	Assert(t, err)
+	Assert(t, w.Close())
+	return signed.String()
+}
+
+func clearsigned(t *testing.T, entity *openpgp.Entity, from, subject, body string) string {
+	return fmt.Sprintf(PlainTemplate, from, To, subject, clearsignText(t, entity, subject+"\n"+body))
+}
+
+// Reply to the mail asking to confirm, as the address
+func confirmPgpKey(t *testing.T, s *Session, sender *fakeSender, address string) {
+	t.Helper()
+	last := sender.sent[len(sender.sent)-1]
+	if last.To != address || !strings.HasPrefix(last.Subject, "Confirm key ") {
+		t.Fatalf("Expected confirmation mail to %s, got %v", address, last)
+	}
+	s.From = &address
+	Assert(t, s.Handle(newPlain(address, To, "Re: "+last.Subject, "")).Err)
+}
+
+// Work account vouches for the key of the personal address, which confirms it
+func registerPgp(t *testing.T, s *Session, key string) {
+	t.Helper()
+	sender := &fakeSender{}
+	s.Sender = sender
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Alias+User3, "User alias\n\n"+key)).Err)
+	if registered := s.Db.GetPgpKey(User3); registered != nil {
+		t.Fatalf("Expected key for %s to wait for confirmation, got %v", User3, registered)
+	}
+	if alias := s.Db.GetEmailsForAlias("User alias"); len(alias) != 2 {
+		t.Errorf("Expected the alias without the key, got %v", alias)
+	}
+
+	confirmPgpKey(t, s, sender, User3)
+	if registered := s.Db.GetPgpKey(User3); registered == nil || registered.AddedBy != User1 {
+		t.Fatalf("Expected key for %s added by %s, got %v", User3, User1, registered)
+	}
+}
+
+func TestPgp(t *testing.T) {
+	entity, key := newPgpEntity(t, User3)
+	other, _ := newPgpEntity(t, User3)
+
+	for _, test := range []struct {
+		name     string
+		mail     string
+		accepted bool
+	}{
+		{"PGP/MIME", pgpMimeSigned(t, entity, User3, Borrow+Tool1, "By the bench"), true},
+		{"clearsigned", clearsigned(t, entity, User3, Borrow+Tool1, "By the bench"), true},
+		{"other key", pgpMimeSigned(t, other, User3, Borrow+Tool1, "By the bench"), false},
+		{"tampered", strings.Replace(
+			pgpMimeSigned(t, entity, User3, Borrow+Tool1, "By the bench"), "bench", "door", 1), false},
+		{"not signed", string(newPlain(User3, To, Borrow+Tool1, "By the bench")), false},
+		// A signed mail resent with another command
+		{"replayed", strings.Replace(
+			pgpMimeSigned(t, entity, User3, Borrow+Tool2, "By the bench"), Borrow+Tool2, Borrow+Tool1, 1), false},
+		{"subject not signed", pgpMimeSign(t, entity, User3, Borrow+Tool1,
+			"Content-Type: text/plain; charset=utf-8\r\n\r\nBy the bench\r\n"), false},
+		{"clearsigned other command", fmt.Sprintf(PlainTemplate, User3, To, Borrow+Tool1,
+			clearsignText(t, entity, Borrow+Tool2+"\nBy the bench")), false},
+		{"clearsigned quoted", fmt.Sprintf(PlainTemplate, User3, To, Borrow+Tool1,
+			"By the bench\n\n> "+strings.ReplaceAll(
+				clearsignText(t, entity, Borrow+Tool1+"\nBy the bench"), "\n", "\n> ")), false},
+		{"clearsigned with text after", fmt.Sprintf(PlainTemplate, User3, To, Borrow+Tool1,
+			clearsignText(t, entity, Borrow+Tool1+"\nBy the bench")+"\nBy the door"), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, s := setup(t, Domain1, false, false)
+			defer conn.Close()
+			registerPgp(t, &s, key)
+
+			s.From = &User3
+			outcome := s.Handle([]byte(test.mail))
+			if test.accepted {
+				Assert(t, outcome.Err)
+			} else if outcome.Err != ErrInvalid {
+				t.Fatalf("Expected %v, got %v", ErrInvalid, outcome.Err)
+			}
+			if test.accepted != strings.HasPrefix(outcome.Pgp, "pass") {
+				t.Errorf("Expected OpenPGP accepted %v, got %q", test.accepted, outcome.Pgp)
+			}
+
+			var expected []db.Item
+			if test.accepted {
+				comment := "By the bench"
+				alias := "User alias"
+				expected = []db.Item{{
+					Location: db.Location{Tool: Tool1, LastSeenBy: User3, Comment: &comment},
+					Alias:    &alias,
+				}}
+			}
+			AssertSlicesEqual(t, expected, itemsByName(conn))
+		})
+	}
+}
+
+func TestPgpNoUid(t *testing.T) {
+	conn, s := setup(t, Domain1, false, false)
+	defer conn.Close()
+
+	_, key := newPgpEntity(t, User4)
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Alias+User3, "User alias\n\n"+key)).Err)
+	if registered := conn.GetPgpKey(User3); registered != nil {
+		t.Fatalf("Expected no key for %s, got %v", User3, registered)
+	}
+	if last := s.Report[len(s.Report)-1]; last.Err != ErrPgpNoUid {
+		t.Errorf("Expected %v, got %v", ErrPgpNoUid, last.Err)
+	}
+}
+
+func TestPgpKeyConfirmation(t *testing.T) {
+	conn, s := setup(t, Domain1, false, false)
+	defer conn.Close()
+
+	_, key := newPgpEntity(t, User3)
+	_, err := s.RequestPgpKey(User3, key, "web")
+	if err != ErrNoSender {
+		t.Fatalf("Expected %v, got %v", ErrNoSender, err)
+	}
+
+	sender := &fakeSender{}
+	s.Sender = sender
+	fingerprint, err := s.RequestPgpKey(User3, key, "web")
+	Assert(t, err)
+	if registered := conn.GetPgpKey(User3); registered != nil {
+		t.Fatalf("Expected no key before confirmation, got %v", registered)
+	}
+
+	// Someone else can't confirm it, even with the token
+	token := strings.TrimPrefix(sender.sent[0].Subject, "Confirm key ")
+	s.From = &User4
+	Assert(t, s.Handle(newPlain(User4, To, "Confirm key "+token, "")).Err)
+	if last := s.Report[len(s.Report)-1]; last.Err != ErrWrongPgpKey {
+		t.Fatalf("Expected %v, got %v", ErrWrongPgpKey, last.Err)
+	}
+
+	confirmPgpKey(t, &s, sender, User3)
+	if registered := conn.GetPgpKey(User3); registered == nil || registered.Fingerprint != fingerprint {
+		t.Fatalf("Expected key %s for %s, got %v", fingerprint, User3, registered)
+	}
+
+	// Replacing it needs confirming too
+	_, other := newPgpEntity(t, User3)
+	_, err = s.RequestPgpKey(User3, other, "web")
+	Assert(t, err)
+	if registered := conn.GetPgpKey(User3); registered == nil || registered.Fingerprint != fingerprint {
+		t.Fatalf("Expected key %s to stay until confirmed, got %v", fingerprint, registered)
+	}
+}
@@ -0,0 +1,91 @@
+package mail
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Characters other than these are encoded as =XX in the tool name, to stay
+// within what is allowed (and unlikely to be mangled) in the local part
+func plusSafe(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '_'
+}
+
+// Encode a command for a tool as a plus address of the tooltracker address
+// `to`, e.g. ("tooltracker@example.com", "borrow", "scope 3", "") gives
+// "tooltracker+borrow.scope=203@example.com". A QR token (see QrToken) goes
+// after another dot.
+func EncodePlusAddress(to, command, tool, token string) string {
+	local, domain, _ := strings.Cut(to, "@")
+	var encoded strings.Builder
+	for _, c := range []byte(tool) {
+		if plusSafe(c) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "=%02X", c)
+		}
+	}
+	if token != "" {
+		encoded.WriteString("." + token)
+	}
+	return fmt.Sprintf("%s+%s.%s@%s", local, command, encoded.String(), domain)
+}
+
+// If address is the tooltracker address `to` with a plus extension, return
+// the extension. The second return is false if it isn't the tooltracker
+// address at all.
+func SplitPlusAddress(address, to string) (string, bool) {
+	address = strings.Trim(strings.TrimSpace(address), "<>")
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return "", false
+	}
+	toLocal, toDomain, _ := strings.Cut(to, "@")
+	if !strings.EqualFold(domain, toDomain) {
+		return "", false
+	}
+	local, extension, _ := strings.Cut(local, "+")
+	if !strings.EqualFold(local, toLocal) {
+		return "", false
+	}
+	return extension, true
+}
+
+// Turn a plus extension such as "borrow.scope=203" into the command it
+// stands for, "Borrowed scope 3"
+func decodePlusCommand(extension string) (string, bool) {
+	command, encoded, ok := strings.Cut(extension, ".")
+	if !ok {
+		return "", false
+	}
+	var keyword string
+	for _, c := range commands {
+		if c.Plus && strings.EqualFold(c.Name, command) {
+			keyword = c.keyword()
+			break
+		}
+	}
+	if keyword == "" {
+		return "", false
+	}
+	encoded, token, _ := strings.Cut(encoded, ".")
+	var tool []byte
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] == '=' && i+2 < len(encoded) {
+			c, err := hex.DecodeString(encoded[i+1 : i+3])
+			if err != nil {
+				return "", false
+			}
+			tool = append(tool, c...)
+			i += 2
+		} else {
+			tool = append(tool, encoded[i])
+		}
+	}
+	if token != "" {
+		return fmt.Sprintf("%s %s (ref %s)", keyword, tool, token), true
+	}
+	return keyword + " " + string(tool), true
+}
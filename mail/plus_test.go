@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"testing"
+
+	"github.com/KoviRobi/tooltracker/db"
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+func TestPlusAddressRoundTrip(t *testing.T) {
+	for _, tool := range []string{"scope-3", "probe set", "PSU 30V/5A", "Kölcsön"} {
+		address := EncodePlusAddress(To, "borrow", tool, "")
+		extension, ok := SplitPlusAddress(address, To)
+		if !ok {
+			t.Fatalf("Expected %s to be a plus address of %s", address, To)
+		}
+		command, ok := decodePlusCommand(extension)
+		if !ok || command != Borrow+tool {
+			t.Fatalf("Expected %q, got %q (%v)", Borrow+tool, command, ok)
+		}
+	}
+
+	if _, ok := SplitPlusAddress("other+borrow.x@"+Domain1, To); ok {
+		t.Fatalf("Expected other address to not match")
+	}
+}
+
+func TestPlusAddressBorrow(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.To = To
+	s.From = &User1
+	rcpt := EncodePlusAddress(To, "borrow", Tool1, "")
+	// Subject mangled by the mail client
+	Assert(t, s.Handle(newPlain(User1, rcpt, "", "")).Err)
+
+	items := itemsByName(conn)
+	expected := []db.Item{
+		{Location: db.Location{Tool: Tool1, LastSeenBy: User1}},
+	}
+	AssertSlicesEqual(t, expected, items)
+}
+
+func TestPlusAddressDoesNotOverrideSubject(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.To = To
+	s.From = &User1
+	// E.g. a signed mail resent to a different plus address
+	rcpt := EncodePlusAddress(To, "borrow", Tool2, "")
+	Assert(t, s.Handle(newPlain(User1, rcpt, Borrow+Tool1, "")).Err)
+
+	items := itemsByName(conn)
+	expected := []db.Item{
+		{Location: db.Location{Tool: Tool1, LastSeenBy: User1}},
+	}
+	AssertSlicesEqual(t, expected, items)
+}
@@ -0,0 +1,71 @@
+package mail
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/KoviRobi/tooltracker/db"
+)
+
+// With Session.QrKey set, the web UI puts a token (an HMAC of the tool ID) in
+// the QR code's subject of registered tools (see db.RegisterTool), e.g.
+// "Borrowed k3x9q2ab (ref 0123456789abcdef)", and commands for those tools are
+// only accepted with a valid one, so only from printed labels.
+// With Session.RegisteredOnly, commands are only accepted for tools already
+// added on the web UI.
+
+var ErrNoQrToken = errors.New("Not from a tool's QR code")
+var ErrNotRegistered = errors.New("Unknown tool, add it on the web UI first")
+
+var qrTokenRe = regexp.MustCompile(`\s*\(ref ([0-9a-fA-F]+)\)\s*$`)
+
+// The token for the tool's QR code
+func QrToken(key []byte, tool string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.TrimSpace(tool)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// The tool with its token, for the subject, or just the tool if there is no
+// key
+func WithQrToken(key []byte, tool string) string {
+	if key == nil {
+		return tool
+	}
+	return fmt.Sprintf("%s (ref %s)", tool, QrToken(key, tool))
+}
+
+// Split the token off the end of the command's argument
+func splitQrToken(arg string) (string, string) {
+	match := qrTokenRe.FindStringSubmatchIndex(arg)
+	if match == nil {
+		return arg, ""
+	}
+	return arg[:match[0]], arg[match[2]:match[3]]
+}
+
+// Whether the token is the tool's, or isn't needed as there is no
+// Session.QrKey or the tool isn't registered
+func (s *Session) validQrToken(tool db.Tool, token string) bool {
+	if s.QrKey == nil || !tool.Registered {
+		return true
+	}
+	return hmac.Equal([]byte(strings.ToLower(token)), []byte(QrToken(s.QrKey, tool.Id)))
+}
+
+// Tell the sender the tool needs adding first, if there is a Sender
+func (s *Session) replyNotRegistered(tool string) {
+	s.Outbox = append(s.Outbox, Outgoing{
+		To:      *s.From,
+		Subject: "Unknown tool " + tool,
+		Body: fmt.Sprintf(
+			"The tooltracker only accepts tools which have been added on its web UI,\n"+
+				"and %q hasn't been. Please scan the tool's QR code, or ask for it to be added.\n",
+			tool),
+	})
+}
@@ -0,0 +1,112 @@
+package mail
+
+import (
+	"testing"
+
+	"github.com/KoviRobi/tooltracker/db"
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+func TestQrToken(t *testing.T) {
+	key := []byte("secret")
+
+	for _, test := range []struct {
+		name    string
+		rcpt    func(id string) string
+		subject func(id string) string
+		body    string
+		// Error reported for the tool, if any
+		err error
+	}{
+		{"QR code", nil, func(id string) string { return Borrow + WithQrToken(key, id) }, "", nil},
+		{"plus address", func(id string) string {
+			return EncodePlusAddress(To, "borrow", id, QrToken(key, id))
+		}, nil, "", nil},
+		{"by name", nil, func(id string) string { return Borrow + Tool1 + " (ref " + QrToken(key, id) + ")" }, "", nil},
+		{"no token", nil, func(id string) string { return Borrow + Tool1 }, "", ErrNoQrToken},
+		{"other tool's token", nil, func(id string) string { return Borrow + id + " (ref " + QrToken(key, Tool2) + ")" }, "", ErrNoQrToken},
+		{"other key", nil, func(id string) string { return Borrow + WithQrToken([]byte("other"), id) }, "", ErrNoQrToken},
+		{"returned", nil, func(id string) string { return "Returned " + Tool1 }, "", ErrNoQrToken},
+		{"tag", nil, func(id string) string { return "Tag " + Tool1 + " +lab" }, "", ErrNoQrToken},
+		{"describe", nil, func(id string) string { return "Describe " + Tool1 }, "Scope", ErrNoQrToken},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, s := setup(t, "", true, true)
+			defer conn.Close()
+			s.QrKey = key
+			s.To = To
+			// Printed by the admin
+			tool, err := conn.AddTool(Tool1)
+			Assert(t, err)
+			Assert(t, conn.RegisterTool(tool.Id))
+
+			rcpt, subject := To, ""
+			if test.rcpt != nil {
+				rcpt = test.rcpt(tool.Id)
+			}
+			if test.subject != nil {
+				subject = test.subject(tool.Id)
+			}
+			s.From = &User1
+			Assert(t, s.Handle(newPlain(User1, rcpt, subject, test.body)).Err)
+			if len(s.Report) != 1 || s.Report[0].Err != test.err {
+				t.Fatalf("Expected %v, got %s", test.err, s.Report)
+			}
+			var expected []db.Item
+			if test.err == nil {
+				expected = []db.Item{{Location: db.Location{Tool: Tool1, LastSeenBy: User1}}}
+			}
+			AssertSlicesEqual(t, expected, itemsByName(conn))
+		})
+	}
+}
+
+func TestQrTokenBatch(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+	s.QrKey = []byte("secret")
+
+	tool, err := conn.AddTool(Tool1)
+	Assert(t, err)
+	Assert(t, conn.RegisterTool(tool.Id))
+
+	// Only the line without the token fails, and unregistered tools don't
+	// need one
+	s.From = &User1
+	body := "Borrowed " + Tool1 + "\nBorrowed " + Tool2 + "\n"
+	Assert(t, s.Handle(newPlain(User1, To, "Batch", body)).Err)
+	if len(s.Report) != 2 || s.Report[0].Err != ErrNoQrToken || s.Report[1].Err != nil {
+		t.Fatalf("Expected only %s to fail, got %s", Tool1, s.Report)
+	}
+	expected := []db.Item{{Location: db.Location{Tool: Tool2, LastSeenBy: User1}}}
+	AssertSlicesEqual(t, expected, itemsByName(conn))
+}
+
+func TestRegisteredOnly(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	sender := &fakeSender{}
+	s.Sender = sender
+	s.RegisteredOnly = true
+
+	s.From = &User1
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "")).Err)
+	if len(s.Report) != 1 || s.Report[0].Err != ErrNotRegistered {
+		t.Fatalf("Expected not registered, got %s", s.Report)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].To != User1 {
+		t.Fatalf("Expected a reply to %s, got %v", User1, sender.sent)
+	}
+	AssertSlicesEqual(t, nil, itemsByName(conn))
+
+	// Added on the web UI
+	_, err := conn.AddTool(Tool1)
+	Assert(t, err)
+	s.Report = nil
+	s.Outbox = nil
+	Assert(t, s.Handle(newPlain(User1, To, Borrow+Tool1, "By the door")).Err)
+	comment := "By the door"
+	expected := []db.Item{{Location: db.Location{Tool: Tool1, LastSeenBy: User1, Comment: &comment}}}
+	AssertSlicesEqual(t, expected, itemsByName(conn))
+}
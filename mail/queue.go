@@ -0,0 +1,198 @@
+package mail
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KoviRobi/tooltracker/db"
+)
+
+// Receivers (SMTP/IMAP) only put mails in the database, see Enqueue, so that
+// nothing is lost if processing fails. Workers then process them, retrying
+// with backoff, until they are either done or dead (see db.QueueDead).
+type Queue struct {
+	// Template for the session of each mail, From and Rcpt are filled in
+	Session      Session
+	ShutdownChan chan struct{}
+	Workers      int
+	MaxAttempts  int
+	// Delay before the first retry, doubled for each retry after that, up to
+	// MaxBackoff
+	Backoff time.Duration
+	// How often workers look for mails due a retry
+	Poll time.Duration
+
+	wake chan struct{}
+	once sync.Once
+}
+
+// Retries are at least this often, however many attempts there have been
+const MaxBackoff = 24 * time.Hour
+
+func (q *Queue) init() {
+	q.once.Do(func() {
+		q.wake = make(chan struct{}, 1)
+	})
+}
+
+// Store a received mail, for the workers to process, see db.Enqueue
+func (q *Queue) Enqueue(mail db.QueuedMail) error {
+	q.init()
+	_, err := q.Session.Db.Enqueue(mail)
+	if err != nil {
+		log.Printf("Failed to queue mail from %s: %v", mail.From, err)
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Process mails until shutdown
+func (q *Queue) Run() {
+	q.init()
+	err := q.Session.Db.RequeueProcessing()
+	if err != nil {
+		log.Printf("%v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range max(q.Workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work()
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work() {
+	for {
+		for q.ProcessNext() {
+			select {
+			case <-q.ShutdownChan:
+				return
+			default:
+			}
+		}
+		select {
+		case <-q.ShutdownChan:
+			return
+		case <-q.wake:
+		case <-time.After(q.Poll):
+		}
+	}
+}
+
+// Process a quarantined or dead mail again, see db.RequeueMail
+func (q *Queue) Reprocess(id int64) error {
+	q.init()
+	err := q.Session.Db.RequeueMail(id)
+	if err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Process the next mail which is due, returns false if there wasn't one
+func (q *Queue) ProcessNext() bool {
+	queued, err := q.Session.Db.ClaimQueued(time.Now())
+	if err != nil {
+		log.Printf("%v", err)
+		return false
+	}
+	if queued == nil {
+		return false
+	}
+
+	q.process(queued)
+	return true
+}
+
+// Store a received mail and process it straight away, for receivers which can
+// tell the sender the outcome (i.e. SMTP). Returns nil if a worker got to it
+// first.
+func (q *Queue) Submit(mail db.QueuedMail) (*Outcome, error) {
+	q.init()
+	id, err := q.Session.Db.Enqueue(mail)
+	if err != nil {
+		log.Printf("Failed to queue mail from %s: %v", mail.From, err)
+		return nil, err
+	}
+	queued, err := q.Session.Db.ClaimQueuedId(id)
+	if err != nil || queued == nil {
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		// Leave it to the workers
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+		return nil, nil
+	}
+	outcome := q.process(queued)
+	return &outcome, nil
+}
+
+// Handle a claimed mail, and finish, quarantine, retry or give up on it
+// depending on the outcome
+func (q *Queue) process(queued *db.QueuedMail) Outcome {
+	s := q.Session
+	s.From = &queued.From
+	s.Rcpt = queued.Rcpt
+	s.ClientIp = net.ParseIP(queued.ClientIp)
+	s.Helo = queued.Helo
+	log.Printf("Processing queued mail %d from %s (attempt %d)", queued.Id, queued.From, queued.Attempts)
+	outcome := s.Handle(queued.Raw)
+
+	var err error
+	reason := ""
+	if outcome.Err != nil {
+		reason = outcome.Err.Error()
+	}
+	if errors.Is(outcome.Err, ErrInvalid) {
+		reason = outcome.Rejection.String()
+		if outcome.Reason != nil {
+			reason = outcome.Reason.Error()
+		}
+	}
+	switch {
+	case outcome.Err == nil:
+		err = s.Db.FinishQueued(queued.Id)
+	case outcome.Quarantined():
+		log.Printf("Quarantining mail %d: %s", queued.Id, reason)
+		err = s.Db.Quarantine(queued.Id, reason, outcome.VerificationSummary())
+	case queued.Attempts >= q.MaxAttempts:
+		log.Printf("Giving up on queued mail %d after %d attempts: %s", queued.Id, queued.Attempts, reason)
+		err = s.Db.DeadLetter(queued.Id, reason)
+	default:
+		retry := time.Now().Add(q.backoff(queued.Attempts))
+		log.Printf("Retrying queued mail %d at %s: %s", queued.Id, retry.Format(time.DateTime), reason)
+		err = s.Db.RetryQueued(queued.Id, reason, retry)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return outcome
+}
+
+// The delay before retrying after the attempts, doubling each time up to
+// MaxBackoff (shifting instead would overflow for many attempts)
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.Backoff
+	for i := 1; i < attempts && delay < MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, MaxBackoff)
+}
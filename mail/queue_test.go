@@ -0,0 +1,132 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KoviRobi/tooltracker/db"
+	"github.com/KoviRobi/tooltracker/ratelimit"
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+func TestQueue(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	q := Queue{Session: s, MaxAttempts: 3}
+	Assert(t, q.Enqueue(db.QueuedMail{From: User1, Rcpt: To, Raw: newPlain(User1, To, Borrow+Tool1, "")}))
+	Assert(t, q.Enqueue(db.QueuedMail{From: User2, Rcpt: To, Raw: newPlain(User2, To, "Not a command", "")}))
+
+	if !q.ProcessNext() || !q.ProcessNext() {
+		t.Fatal("Expected two queued mails")
+	}
+	if q.ProcessNext() {
+		t.Error("Expected the queue to be empty")
+	}
+
+	items := itemsByName(conn)
+	expected := []db.Item{
+		{
+			Location: db.Location{
+				Tool:       Tool1,
+				LastSeenBy: User1,
+			},
+		},
+	}
+	AssertSlicesEqual(t, expected, items)
+	// The invalid mail is quarantined rather than retried
+	if queue := conn.GetQueue(db.QueueWaiting); len(queue) != 0 {
+		t.Errorf("Expected nothing waiting, got %v", queue)
+	}
+	quarantined := conn.GetQueue(db.QueueQuarantined)
+	if len(quarantined) != 1 || quarantined[0].From != User2 ||
+		quarantined[0].LastError == nil || !strings.Contains(*quarantined[0].LastError, "Bad command") {
+		t.Fatalf("Expected the bad command to be quarantined, got %v", quarantined)
+	}
+
+	// E.g. after adding a language with the keyword
+	Assert(t, q.Reprocess(quarantined[0].Id))
+	if !q.ProcessNext() {
+		t.Fatal("Expected the requeued mail")
+	}
+	if quarantined := conn.GetQueue(db.QueueQuarantined); len(quarantined) != 1 {
+		t.Errorf("Expected the mail to be quarantined again, got %v", quarantined)
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	q := Queue{Session: s, MaxAttempts: 2, Backoff: time.Hour}
+	Assert(t, q.Enqueue(db.QueuedMail{From: User1, Rcpt: To, Raw: newPlain(User1, To, Borrow+Tool1, "")}))
+
+	// Cause a database error
+	_, err := conn.Exec(`DROP TABLE tracker`)
+	Assert(t, err)
+
+	if !q.ProcessNext() {
+		t.Fatal("Expected a queued mail")
+	}
+	if q.ProcessNext() {
+		t.Error("Expected the retry to be delayed")
+	}
+	queue := conn.GetQueue(db.QueueWaiting)
+	if len(queue) != 1 || queue[0].Attempts != 1 || queue[0].LastError == nil {
+		t.Fatalf("Expected one failed attempt, got %v", queue)
+	}
+
+	// Retry now
+	Assert(t, conn.RetryQueued(queue[0].Id, *queue[0].LastError, time.Now()))
+	if !q.ProcessNext() {
+		t.Fatal("Expected a queued mail")
+	}
+	dead := conn.GetQueue(db.QueueDead)
+	if len(dead) != 1 || dead[0].Attempts != 2 {
+		t.Fatalf("Expected a dead mail, got %v", dead)
+	}
+	if queue := conn.GetQueue(db.QueueWaiting); len(queue) != 0 {
+		t.Errorf("Expected nothing waiting, got %v", queue)
+	}
+}
+
+func TestQueueRateLimited(t *testing.T) {
+	conn, s := setup(t, "", true, true)
+	defer conn.Close()
+
+	s.Limits.Sender = ratelimit.New(1, 1)
+	q := Queue{Session: s, MaxAttempts: 3, Backoff: time.Hour}
+	Assert(t, q.Enqueue(db.QueuedMail{From: User1, Rcpt: To, Raw: newPlain(User1, To, Borrow+Tool1, "")}))
+	Assert(t, q.Enqueue(db.QueuedMail{From: User1, Rcpt: To, Raw: newPlain(User1, To, Borrow+Tool2, "")}))
+
+	if !q.ProcessNext() || !q.ProcessNext() {
+		t.Fatal("Expected two queued mails")
+	}
+	// Retried once the bucket refills, rather than quarantined
+	if quarantined := conn.GetQueue(db.QueueQuarantined); len(quarantined) != 0 {
+		t.Errorf("Expected nothing quarantined, got %v", quarantined)
+	}
+	queue := conn.GetQueue(db.QueueWaiting)
+	if len(queue) != 1 || queue[0].Attempts != 1 || queue[0].LastError == nil ||
+		!strings.Contains(*queue[0].LastError, ErrRateLimited.Error()) {
+		t.Fatalf("Expected the rate limited mail to be retried, got %v", queue)
+	}
+	if q.ProcessNext() {
+		t.Error("Expected the retry to be delayed")
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := Queue{Backoff: time.Minute}
+	for attempts, expected := range map[int]time.Duration{
+		1:   time.Minute,
+		2:   2 * time.Minute,
+		5:   16 * time.Minute,
+		100: MaxBackoff,
+	} {
+		if delay := q.backoff(attempts); delay != expected {
+			t.Errorf("Expected %s after %d attempts, got %s", expected, attempts, delay)
+		}
+	}
+}
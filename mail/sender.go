@@ -0,0 +1,49 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// An e-mail to send once the incoming mail has been processed successfully
+type Outgoing struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends replies, confirmation requests and so on
+type Sender interface {
+	Send(out Outgoing) error
+}
+
+// Sends mail through an SMTP relay, e.g. the org's MTA
+type SmtpSender struct {
+	// host:port of the relay
+	Addr string
+	// Address of the tooltracker, the replies come from here
+	From string
+}
+
+func (s SmtpSender) Send(out Outgoing) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", out.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", out.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&msg, "\r\n%s\r\n", strings.ReplaceAll(out.Body, "\n", "\r\n"))
+
+	err := smtp.SendMail(s.Addr, nil, s.From, []string{out.To}, &msg)
+	if err != nil {
+		err = fmt.Errorf("Failed to send mail to %s: %w", out.To, err)
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// S/MIME (RFC 8551) signed mail proves the sender too, if the certificate is
+// for the sender's address and chains up to one of Session.SmimeRoots. This is
+// for organisations which don't DKIM sign, but whose staff have certificates.
+// Only the signed part is covered, so the subject has to be in there too,
+// otherwise a signed mail could be resent with a different command.
+
+var ErrNotSigned = errors.New("Not signed")
+var ErrSignedStructure = errors.New("Bad multipart/signed structure")
+var ErrSmimeAddress = errors.New("S/MIME certificate isn't for the sender")
+var ErrUnsignedSubject = errors.New("Subject isn't in the signed part")
+
+// PKCS #9 emailAddress, in the certificate's subject
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+func headerValue(fields []headerField, name string) string {
+	for _, field := range fields {
+		if field.name == name {
+			return strings.TrimSpace(foldingRe.ReplaceAllString(field.value(), ""))
+		}
+	}
+	return ""
+}
+
+// The signed content, including its MIME headers, and the signature part of a
+// multipart/signed body with one of the protocols. Also used for PGP/MIME.
+func splitSigned(fields []headerField, body string, protocols ...string) (string, string, error) {
+	mediaType, params, err := mime.ParseMediaType(headerValue(fields, "content-type"))
+	if err != nil || mediaType != "multipart/signed" {
+		return "", "", ErrNotSigned
+	}
+	if !slices.Contains(protocols, strings.ToLower(params["protocol"])) {
+		return "", "", ErrNotSigned
+	}
+	if params["boundary"] == "" {
+		return "", "", fmt.Errorf("%w: no boundary", ErrSignedStructure)
+	}
+
+	// The CRLF before a delimiter belongs to it, not the part
+	parts := strings.Split("\r\n"+body, "\r\n--"+params["boundary"])
+	if len(parts) < 4 || !strings.HasPrefix(parts[3], "--") {
+		return "", "", fmt.Errorf("%w: expected 2 parts", ErrSignedStructure)
+	}
+	var contents []string
+	for _, part := range parts[1:3] {
+		// Rest of the delimiter line
+		_, content, ok := strings.Cut(part, "\r\n")
+		if !ok {
+			return "", "", fmt.Errorf("%w: empty part", ErrSignedStructure)
+		}
+		contents = append(contents, content)
+	}
+	return contents[0], contents[1], nil
+}
+
+// Whether the signed part has the subject, as the mail's own headers aren't
+// signed: either in the headers of a wrapped message/rfc822 (RFC 8551 section
+// 3.1), or as protected headers of the signed part (e.g. Thunderbird).
+func signsSubject(signed, subject string) bool {
+	fields, body := splitMessage([]byte(signed))
+	mediaType, _, _ := mime.ParseMediaType(headerValue(fields, "content-type"))
+	if mediaType == "message/rfc822" {
+		fields, _ = splitMessage([]byte(body))
+	}
+	for _, field := range fields {
+		if field.name != "subject" {
+			continue
+		}
+		value := strings.TrimSpace(foldingRe.ReplaceAllString(field.value(), ""))
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		return strings.TrimSpace(value) == strings.TrimSpace(subject)
+	}
+	return false
+}
+
+// The DER of the signature part
+func decodeSignature(part string) ([]byte, error) {
+	fields, body := splitMessage([]byte(part))
+	mediaType, _, err := mime.ParseMediaType(headerValue(fields, "content-type"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSignedStructure, err)
+	}
+	switch mediaType {
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+	default:
+		return nil, fmt.Errorf("%w: signature is %s", ErrSignedStructure, mediaType)
+	}
+	if strings.EqualFold(headerValue(fields, "content-transfer-encoding"), "base64") {
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	}
+	return []byte(body), nil
+}
+
+// The addresses the certificate is for
+func certificateEmails(cert *x509.Certificate) []string {
+	var emails []string
+	for _, email := range cert.EmailAddresses {
+		emails = append(emails, strings.ToLower(email))
+	}
+	for _, name := range cert.Subject.Names {
+		if email, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+			emails = append(emails, strings.ToLower(email))
+		}
+	}
+	return emails
+}
+
+// The signer's certificate, if the signature is valid and covers the subject,
+// and the certificate is currently valid for e-mail and trusted
+func verifySmime(raw []byte, roots *x509.CertPool, subject string) (*x509.Certificate, error) {
+	fields, body := splitMessage(raw)
+	signed, signature, err := splitSigned(fields, body,
+		"application/pkcs7-signature", "application/x-pkcs7-signature")
+	if err != nil {
+		return nil, err
+	}
+	der, err := decodeSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, err
+	}
+	p7.Content = []byte(signed)
+	// Not at the signing time, which the signer chooses
+	if err := p7.VerifyWithChainAtTime(roots, time.Now()); err != nil {
+		return nil, err
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, fmt.Errorf("%w: expected one signer", ErrSignedStructure)
+	}
+	// The above accepts any extended key usage
+	intermediates := x509.NewCertPool()
+	for _, cert := range p7.Certificates {
+		intermediates.AddCert(cert)
+	}
+	_, err = signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !signsSubject(signed, subject) {
+		return nil, ErrUnsignedSubject
+	}
+	return signer, nil
+}
+
+// Whether the mail is S/MIME signed by the sender, from the domain
+func (s *Session) checkSmime(reader io.Reader, domain string) bool {
+	var buf bytes.Buffer
+	buf.ReadFrom(reader)
+	signer, err := verifySmime(buf.Bytes(), s.SmimeRoots, s.subject)
+	if errors.Is(err, ErrNotSigned) {
+		s.smime = "none"
+		return false
+	} else if err != nil {
+		log.Printf("S/MIME: %v", err)
+		s.smime = "fail: " + err.Error()
+		return false
+	}
+	s.smime = "pass " + signer.Subject.String()
+	if !slices.Contains(certificateEmails(signer), strings.ToLower(*s.From)) ||
+		!strings.EqualFold(domainOf(*s.From), domain) {
+		log.Printf("S/MIME: %v: %s for %v", ErrSmimeAddress, *s.From, certificateEmails(signer))
+		s.smime = fmt.Sprintf("fail: %v %v", ErrSmimeAddress, certificateEmails(signer))
+		return false
+	}
+	return true
+}
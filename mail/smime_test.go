@@ -0,0 +1,158 @@
+package mail
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+
+	"github.com/KoviRobi/tooltracker/db"
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+func newCertificate(t *testing.T, template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Assert(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	if template.NotAfter.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	Assert(t, err)
+	cert, err := x509.ParseCertificate(der)
+	Assert(t, err)
+	return cert, key
+}
+
+func newCa(t *testing.T, name string) (*x509.Certificate, crypto.Signer) {
+	return newCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+}
+
+// A certificate for the address, as a mail client would have
+func smimeCertificate(email string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+}
+
+// A multipart/signed mail of the content (with its MIME headers)
+func smimeSign(t *testing.T, template, ca *x509.Certificate, caKey crypto.Signer, from, subject, content string) string {
+	cert, key := newCertificate(t, template, ca, caKey)
+
+	signedData, err := pkcs7.NewSignedData([]byte(content))
+	Assert(t, err)
+	Assert(t, signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{}))
+	signedData.Detach()
+	der, err := signedData.Finish()
+	Assert(t, err)
+
+	return fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\";\r\n"+
+		" micalg=sha-256; boundary=\"boundary\"\r\n"+
+		"\r\n"+
+		"This is a cryptographically signed message in MIME format.\r\n"+
+		"\r\n"+
+		"--boundary\r\n"+
+		"%s\r\n"+
+		"--boundary\r\n"+
+		"Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		"%s\r\n"+
+		"--boundary--\r\n",
+		from, To, subject, content, base64.StdEncoding.EncodeToString(der))
+}
+
+// A signed mail with the subject in protected headers, as e.g. Thunderbird
+// would send
+func smimeSigned(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, email, from, subject, body string) string {
+	content := "Content-Type: text/plain; charset=utf-8; protected-headers=\"v1\"\r\n" +
+		"Subject: " + subject + "\r\n\r\n" + body + "\r\n"
+	return smimeSign(t, smimeCertificate(email), ca, caKey, from, subject, content)
+}
+
+func TestSmime(t *testing.T) {
+	ca, caKey := newCa(t, "Partner CA")
+	otherCa, otherCaKey := newCa(t, "Other CA")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	signed := smimeSigned(t, ca, caKey, User1, User1, Borrow+Tool1, "By the bench")
+	plain := "Content-Type: text/plain; charset=utf-8\r\n\r\nBy the bench\r\n"
+	protected := "Content-Type: text/plain; charset=utf-8; protected-headers=\"v1\"\r\n" +
+		"Subject: " + Borrow + Tool1 + "\r\n\r\nBy the bench\r\n"
+	// RFC 8551 section 3.1
+	wrapped := "Content-Type: message/rfc822\r\n\r\n" + strings.ReplaceAll(
+		fmt.Sprintf(PlainTemplate, User1, To, Borrow+Tool1, "By the bench"), "\n", "\r\n")
+	expired := smimeCertificate(User1)
+	expired.NotBefore = time.Now().Add(-2 * time.Hour)
+	expired.NotAfter = time.Now().Add(-time.Hour)
+	notForMail := smimeCertificate(User1)
+	notForMail.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	for _, test := range []struct {
+		name     string
+		mail     string
+		accepted bool
+	}{
+		{"trusted", signed, true},
+		{"untrusted", smimeSigned(t, otherCa, otherCaKey, User1, User1, Borrow+Tool1, "By the bench"), false},
+		{"other address", smimeSigned(t, ca, caKey, User2, User1, Borrow+Tool1, "By the bench"), false},
+		{"tampered", strings.Replace(signed, "By the bench", "By the door", 1), false},
+		// Only the outer subject changed
+		{"replayed", strings.Replace(signed, Borrow+Tool1, Borrow+Tool2, 1), false},
+		{"subject not signed", smimeSign(t, smimeCertificate(User1), ca, caKey, User1, Borrow+Tool1, plain), false},
+		{"wrapped", smimeSign(t, smimeCertificate(User1), ca, caKey, User1, Borrow+Tool1, wrapped), true},
+		{"expired", smimeSign(t, expired, ca, caKey, User1, Borrow+Tool1, protected), false},
+		{"not for e-mail", smimeSign(t, notForMail, ca, caKey, User1, Borrow+Tool1, protected), false},
+		{"not signed", fmt.Sprintf(PlainTemplate, User1, To, Borrow+Tool1, "By the bench"), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, s := setup(t, Domain1, true, true)
+			defer conn.Close()
+			s.SmimeRoots = roots
+
+			s.From = &User1
+			outcome := s.Handle([]byte(test.mail))
+			if test.accepted {
+				Assert(t, outcome.Err)
+			} else if outcome.Err != ErrInvalid {
+				t.Fatalf("Expected %v, got %v", ErrInvalid, outcome.Err)
+			}
+			if test.accepted != strings.HasPrefix(outcome.Smime, "pass") {
+				t.Errorf("Expected S/MIME accepted %v, got %q", test.accepted, outcome.Smime)
+			}
+
+			var expected []db.Item
+			if test.accepted {
+				comment := "By the bench"
+				expected = []db.Item{{Location: db.Location{Tool: Tool1, LastSeenBy: User1, Comment: &comment}}}
+			}
+			AssertSlicesEqual(t, expected, itemsByName(conn))
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// Token bucket rate limits, so that one sender (or client, or tool) can't flood
+// the tracker, and a cap on how many new tools can appear in a day. Shared by
+// the SMTP server and the mail handling, shown on the status page.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Full buckets are only removed once there are this many
+const pruneBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// A token bucket per key, e.g. per sender address. A nil Limiter allows
+// everything.
+type Limiter struct {
+	// Tokens added per hour
+	PerHour float64
+	// Most tokens a bucket holds, i.e. how many can be used at once
+	Burst float64
+
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	rejected uint64
+	// For tests
+	now func() time.Time
+}
+
+// nil (unlimited) if perHour isn't positive
+func New(perHour float64, burst int) *Limiter {
+	if perHour <= 0 {
+		return nil
+	}
+	return &Limiter{
+		PerHour: perHour,
+		Burst:   float64(max(burst, 1)),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take a token from the key's bucket, false if it is empty
+func (l *Limiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= pruneBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.Burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.Burst, b.tokens+now.Sub(b.at).Hours()*l.PerHour)
+	b.at = now
+	if b.tokens < 1 {
+		l.rejected++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Remove the buckets which would be full by now, they are the same as new ones
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.at).Hours()*l.PerHour >= l.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// How many times Allow returned false
+func (l *Limiter) Rejected() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rejected
+}
+
+// At most Max per (local) day. A nil DailyCap allows everything.
+type DailyCap struct {
+	Max int
+
+	mu       sync.Mutex
+	day      string
+	count    int
+	rejected uint64
+	// For tests
+	now func() time.Time
+}
+
+// nil (unlimited) if max isn't positive
+func NewDailyCap(max int) *DailyCap {
+	if max <= 0 {
+		return nil
+	}
+	return &DailyCap{Max: max, now: time.Now}
+}
+
+// Count one more for today, false if there have been Max already
+func (c *DailyCap) Take() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if day := c.now().Format(time.DateOnly); day != c.day {
+		c.day = day
+		c.count = 0
+	}
+	if c.count >= c.Max {
+		c.rejected++
+		return false
+	}
+	c.count++
+	return true
+}
+
+// How many times Take returned false
+func (c *DailyCap) Rejected() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rejected
+}
+
+// All the limits, nil ones are unlimited
+type Limits struct {
+	// Per SMTP client IP, checked for each connection
+	Ip *Limiter
+	// Per sender (after delegation), checked for each mail
+	Sender *Limiter
+	// Per tool, checked for each command changing it
+	Tool *Limiter
+	// Tools which weren't in the tracker before
+	NewTools *DailyCap
+}
+
+// How many were rejected by each limit
+type Stats struct {
+	Ip       uint64
+	Sender   uint64
+	Tool     uint64
+	NewTools uint64
+}
+
+func (l Limits) Stats() Stats {
+	return Stats{
+		Ip:       l.Ip.Rejected(),
+		Sender:   l.Sender.Rejected(),
+		Tool:     l.Tool.Rejected(),
+		NewTools: l.NewTools.Rejected(),
+	}
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func TestLimiter(t *testing.T) {
+	c := &clock{time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)}
+	l := New(60, 2)
+	l.now = c.now
+
+	if !l.Allow("a") || !l.Allow("a") {
+		t.Fatal("Expected the burst to be allowed")
+	}
+	if l.Allow("a") {
+		t.Fatal("Expected the empty bucket to be rejected")
+	}
+	if !l.Allow("b") {
+		t.Fatal("Expected other keys to have their own bucket")
+	}
+
+	// One per minute
+	c.t = c.t.Add(time.Minute)
+	if !l.Allow("a") {
+		t.Fatal("Expected the bucket to refill")
+	}
+	if l.Allow("a") {
+		t.Fatal("Expected only one token to be refilled")
+	}
+
+	// Not more than the burst
+	c.t = c.t.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !l.Allow("a") {
+			t.Fatal("Expected the burst to be allowed")
+		}
+	}
+	if l.Allow("a") {
+		t.Fatal("Expected the bucket to hold at most the burst")
+	}
+
+	if rejected := l.Rejected(); rejected != 3 {
+		t.Errorf("Expected 3 rejected, got %d", rejected)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var limits Limits
+	limits.Sender = New(0, 10)
+	for i := 0; i < 100; i++ {
+		if !limits.Sender.Allow("a") || !limits.NewTools.Take() {
+			t.Fatal("Expected no limit")
+		}
+	}
+	if stats := limits.Stats(); stats != (Stats{}) {
+		t.Errorf("Expected nothing rejected, got %v", stats)
+	}
+}
+
+func TestDailyCap(t *testing.T) {
+	c := &clock{time.Date(2024, 1, 1, 23, 0, 0, 0, time.Local)}
+	daily := NewDailyCap(2)
+	daily.now = c.now
+
+	if !daily.Take() || !daily.Take() {
+		t.Fatal("Expected the first two to be allowed")
+	}
+	if daily.Take() {
+		t.Fatal("Expected the third to be rejected")
+	}
+
+	c.t = c.t.Add(2 * time.Hour)
+	if !daily.Take() {
+		t.Fatal("Expected the count to reset the next day")
+	}
+	if rejected := daily.Rejected(); rejected != 1 {
+		t.Errorf("Expected 1 rejected, got %d", rejected)
+	}
+}
@@ -0,0 +1,303 @@
+// A caching DNS stub resolver, so that each mail (DKIM, SPF, DMARC, ARC) doesn't
+// need live DNS lookups, and so that an internal nameserver can be used. See
+// mail.SetResolver.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const DefaultTimeout = 5 * time.Second
+
+// For NXDOMAIN/no data answers without an SOA to say how long
+const DefaultNegativeTtl = 5 * time.Minute
+
+// Cap on how long to trust an answer, regardless of its TTL
+const DefaultMaxTtl = 24 * time.Hour
+
+// Expired entries are only removed once the cache is this big
+const pruneEntries = 10000
+
+var ErrNoServers = errors.New("No nameservers configured")
+
+type Stats struct {
+	// Lookups, each is a hit or a miss
+	Queries uint64
+	// Answered from the cache, including negative answers
+	Hits uint64
+	// Of which negative (NXDOMAIN/no data)
+	NegativeHits uint64
+	// Sent to a nameserver
+	Misses uint64
+	// Nameservers not answering in time
+	Timeouts uint64
+	// SERVFAIL, refused, network errors...
+	Errors uint64
+	// Currently cached, including expired ones not yet pruned
+	Entries int
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	// nil if the name doesn't exist or has no records of the type
+	answer  []dns.RR
+	expires time.Time
+}
+
+type Resolver struct {
+	// host:port, the port defaults to 53. Tried in order until one answers.
+	Servers []string
+	// For each nameserver
+	Timeout     time.Duration
+	NegativeTtl time.Duration
+	MaxTtl      time.Duration
+
+	mu    sync.Mutex
+	cache map[cacheKey]cacheEntry
+	stats Stats
+	// For tests
+	now func() time.Time
+}
+
+func New(servers []string) *Resolver {
+	var withPorts []string
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		withPorts = append(withPorts, server)
+	}
+	return &Resolver{
+		Servers:     withPorts,
+		Timeout:     DefaultTimeout,
+		NegativeTtl: DefaultNegativeTtl,
+		MaxTtl:      DefaultMaxTtl,
+		cache:       make(map[cacheKey]cacheEntry),
+		now:         time.Now,
+	}
+}
+
+// Using the nameservers in e.g. /etc/resolv.conf
+func FromConfig(path string) (*Resolver, error) {
+	config, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Servers) == 0 {
+		return nil, ErrNoServers
+	}
+	var servers []string
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	return New(servers), nil
+}
+
+func (r *Resolver) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Entries = len(r.cache)
+	return stats
+}
+
+func (r *Resolver) count(counter *uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*counter++
+}
+
+func (r *Resolver) cached(key cacheKey) (cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Queries++
+	entry, ok := r.cache[key]
+	if !ok || !r.now().Before(entry.expires) {
+		r.stats.Misses++
+		return cacheEntry{}, false
+	}
+	r.stats.Hits++
+	if entry.answer == nil {
+		r.stats.NegativeHits++
+	}
+	return entry, true
+}
+
+func (r *Resolver) store(key cacheKey, answer []dns.RR, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if len(r.cache) >= pruneEntries {
+		for key, entry := range r.cache {
+			if !now.Before(entry.expires) {
+				delete(r.cache, key)
+			}
+		}
+	}
+	r.cache[key] = cacheEntry{answer: answer, expires: now.Add(min(ttl, r.MaxTtl))}
+}
+
+// How long a negative answer can be cached (RFC 2308 section 5)
+func (r *Resolver) negativeTtl(msg *dns.Msg) time.Duration {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		}
+	}
+	return r.NegativeTtl
+}
+
+// Ask the nameservers in turn
+func (r *Resolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if len(r.Servers) == 0 {
+		return nil, ErrNoServers
+	}
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	query.SetEdns0(dns.DefaultMsgSize, false)
+
+	var err error
+	for _, server := range r.Servers {
+		var msg *dns.Msg
+		client := &dns.Client{Timeout: r.Timeout}
+		msg, _, err = client.ExchangeContext(ctx, query, server)
+		if err == nil && msg.Truncated {
+			client.Net = "tcp"
+			msg, _, err = client.ExchangeContext(ctx, query, server)
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			r.count(&r.stats.Timeouts)
+			continue
+		} else if err != nil {
+			r.count(&r.stats.Errors)
+			continue
+		}
+		if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+			r.count(&r.stats.Errors)
+			err = fmt.Errorf("%s from %s", dns.RcodeToString[msg.Rcode], server)
+			continue
+		}
+		return msg, nil
+	}
+	return nil, err
+}
+
+// The records of the type for the name, from the cache if possible. Returns a
+// *net.DNSError like net.Resolver, so that callers can check IsNotFound.
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	key := cacheKey{name, qtype}
+	if entry, ok := r.cached(key); ok {
+		if entry.answer == nil {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return entry.answer, nil
+	}
+
+	msg, err := r.exchange(ctx, name, qtype)
+	if err != nil {
+		var netErr net.Error
+		timeout := errors.As(err, &netErr) && netErr.Timeout()
+		return nil, &net.DNSError{Err: err.Error(), Name: name, IsTimeout: timeout, IsTemporary: true}
+	}
+
+	var answer []dns.RR
+	var ttl uint32
+	for _, rr := range msg.Answer {
+		// Ignore e.g. the CNAMEs followed to get there
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		if answer == nil || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+		answer = append(answer, rr)
+	}
+	if answer == nil {
+		r.store(key, nil, r.negativeTtl(msg))
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	r.store(key, answer, time.Duration(ttl)*time.Second)
+	return answer, nil
+}
+
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answer, err := r.lookup(ctx, name, dns.TypeTXT)
+	var txts []string
+	for _, rr := range answer {
+		// Like net.LookupTXT, the strings of one record are joined
+		txts = append(txts, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+	return txts, err
+}
+
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answer, err := r.lookup(ctx, name, dns.TypeMX)
+	var mxs []*net.MX
+	for _, rr := range answer {
+		mx := rr.(*dns.MX)
+		mxs = append(mxs, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+	}
+	slices.SortStableFunc(mxs, func(a, b *net.MX) int { return int(a.Pref) - int(b.Pref) })
+	return mxs, err
+}
+
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	var addrs []net.IPAddr
+	var errs []error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answer, err := r.lookup(ctx, host, qtype)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, rr := range answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.IPAddr{IP: rr.A})
+			case *dns.AAAA:
+				addrs = append(addrs, net.IPAddr{IP: rr.AAAA})
+			}
+		}
+	}
+	if addrs != nil {
+		return addrs, nil
+	}
+	// Not found is only reported if neither lookup failed otherwise
+	for _, err := range errs {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && !dnsErr.IsNotFound {
+			return nil, err
+		}
+	}
+	return nil, errs[0]
+}
+
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	reverse, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+	answer, err := r.lookup(ctx, reverse, dns.TypePTR)
+	var names []string
+	for _, rr := range answer {
+		names = append(names, rr.(*dns.PTR).Ptr)
+	}
+	return names, err
+}
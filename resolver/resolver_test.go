@@ -0,0 +1,169 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	. "github.com/KoviRobi/tooltracker/test_utils"
+)
+
+// An in-process nameserver answering from fixed records, counting queries
+type testServer struct {
+	records map[string][]dns.RR
+	queries atomic.Int32
+}
+
+func (ts *testServer) ServeDNS(w dns.ResponseWriter, query *dns.Msg) {
+	ts.queries.Add(1)
+	msg := new(dns.Msg)
+	msg.SetReply(query)
+	question := query.Question[0]
+	rrs, ok := ts.records[question.Name]
+	if !ok {
+		msg.Rcode = dns.RcodeNameError
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == question.Qtype {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	if msg.Answer == nil {
+		soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")
+		msg.Ns = append(msg.Ns, soa)
+	}
+	w.WriteMsg(msg)
+}
+
+func serve(t *testing.T, records ...string) (*testServer, string) {
+	ts := &testServer{records: make(map[string][]dns.RR)}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		Assert(t, err)
+		ts.records[rr.Header().Name] = append(ts.records[rr.Header().Name], rr)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Assert(t, err)
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: ts, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return ts, conn.LocalAddr().String()
+}
+
+// A nameserver which never answers
+func blackhole(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Assert(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func newTestResolver(servers ...string) (*Resolver, *time.Time) {
+	r := New(servers)
+	r.Timeout = 200 * time.Millisecond
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestCache(t *testing.T) {
+	ts, addr := serve(t,
+		`sel._domainkey.example.com. 300 IN TXT "v=DKIM1; k=rsa; " "p=abc"`,
+		`example.com. 600 IN TXT "v=spf1 -all"`,
+	)
+	r, now := newTestResolver(addr)
+	ctx := context.Background()
+
+	for range 2 {
+		txts, err := r.LookupTXT(ctx, "sel._domainkey.example.com")
+		Assert(t, err)
+		AssertStringSlicesEqual(t, []string{"v=DKIM1; k=rsa; p=abc"}, txts)
+	}
+	if queries := ts.queries.Load(); queries != 1 {
+		t.Errorf("Expected 1 query, got %d", queries)
+	}
+
+	// Expires with the TTL
+	*now = now.Add(301 * time.Second)
+	_, err := r.LookupTXT(ctx, "SEL._domainkey.example.com.")
+	Assert(t, err)
+	if queries := ts.queries.Load(); queries != 2 {
+		t.Errorf("Expected 2 queries, got %d", queries)
+	}
+
+	stats := r.Stats()
+	if stats.Queries != 3 || stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	ts, addr := serve(t, `example.com. 600 IN TXT "v=spf1 -all"`)
+	r, now := newTestResolver(addr)
+	ctx := context.Background()
+
+	for _, name := range []string{"_dmarc.example.com", "_dmarc.example.com", "example.com"} {
+		_, err := r.LookupMX(ctx, name)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("Expected not found for %s, got %v", name, err)
+		}
+	}
+	if queries := ts.queries.Load(); queries != 2 {
+		t.Errorf("Expected 2 queries, got %d", queries)
+	}
+
+	// The SOA's minimum TTL
+	*now = now.Add(61 * time.Second)
+	r.LookupMX(ctx, "_dmarc.example.com")
+	if queries := ts.queries.Load(); queries != 3 {
+		t.Errorf("Expected 3 queries, got %d", queries)
+	}
+
+	if stats := r.Stats(); stats.NegativeHits != 1 {
+		t.Errorf("Expected 1 negative hit, got %+v", stats)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	ts, addr := serve(t,
+		`mail.example.com. 300 IN A 192.0.2.1`,
+		`mail.example.com. 300 IN AAAA 2001:db8::1`,
+	)
+	r, _ := newTestResolver(blackhole(t), addr)
+
+	addrs, err := r.LookupIPAddr(context.Background(), "mail.example.com")
+	Assert(t, err)
+	if len(addrs) != 2 || !addrs[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Unexpected addresses %v", addrs)
+	}
+	if queries := ts.queries.Load(); queries != 2 {
+		t.Errorf("Expected 2 queries, got %d", queries)
+	}
+	if stats := r.Stats(); stats.Timeouts != 2 {
+		t.Errorf("Expected 2 timeouts, got %+v", stats)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	r, _ := newTestResolver(blackhole(t))
+
+	_, err := r.LookupTXT(context.Background(), "example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+	// Errors aren't cached
+	r.LookupTXT(context.Background(), "example.com")
+	if stats := r.Stats(); stats.Timeouts != 2 || stats.Entries != 0 {
+		t.Errorf("Expected 2 timeouts, got %+v", stats)
+	}
+}
@@ -4,36 +4,65 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net"
 	"regexp"
 
 	"github.com/KoviRobi/tooltracker/db"
 	"github.com/KoviRobi/tooltracker/limits"
 	"github.com/KoviRobi/tooltracker/mail"
+	"github.com/KoviRobi/tooltracker/ratelimit"
 	"github.com/emersion/go-smtp"
 )
 
 var InvalidError = errors.New("Invalid SMTP envelope")
 
+// Temporary, so that the sending server tries again later
+var ErrQueue = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Failed to queue mail, try again later",
+}
+
+// Temporary too, the client can come back once its bucket refills
+var ErrRateLimited = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many connections, try again later",
+}
+
 // The Backend implements SMTP server methods.
 type Backend struct {
-	Db           db.DB
-	FromRe       *regexp.Regexp
+	FromRe *regexp.Regexp
+	// Received mails are only queued, the queue's workers process them
+	Queue        *mail.Queue
 	ShutdownChan chan struct{}
 	To           string
-	Dkim         string
-	Delegate     bool
-	LocalDkim    bool
+	// Only Limits.Ip is checked here, the rest by the queue's Session
+	Limits ratelimit.Limits
 }
 
 // NewSession is called after client greeting (EHLO, HELO).
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{Backend: bkd}, nil
+	session := &Session{Backend: bkd, Helo: c.Hostname()}
+	if addr, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		session.ClientIp = addr.IP.String()
+	}
+	if !bkd.Limits.Ip.Allow(session.ClientIp) {
+		log.Printf("Rate limiting %s", session.ClientIp)
+		return nil, ErrRateLimited
+	}
+	return session, nil
 }
 
 // A Session is returned after successful login.
 type Session struct {
 	Backend *Backend
 	From    *string
+	// Recipient, might be a plus address with a command in it
+	To string
+	// For SPF
+	ClientIp string
+	Helo     string
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
@@ -44,20 +73,21 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	log.Println("Rcpt to:", to)
-	if to != s.Backend.To {
+	extension, ok := mail.SplitPlusAddress(to, s.Backend.To)
+	if !ok {
 		log.Println("Expecting rcpt to:", s.Backend.To)
 		return InvalidError
 	}
+	if s.To == "" || extension != "" {
+		s.To = to
+	}
 	return nil
 }
 
 func (s *Session) Data(r io.Reader) error {
-	mailSession := mail.Session{
-		Db:        s.Backend.Db,
-		Dkim:      s.Backend.Dkim,
-		Delegate:  s.Backend.Delegate,
-		LocalDkim: s.Backend.LocalDkim,
-		From:      s.From,
+	if s.From == nil {
+		log.Println("No `from` in for this mail")
+		return InvalidError
 	}
 	buf := make([]byte, limits.MaxMessageBytes)
 	n, err := r.Read(buf)
@@ -65,10 +95,58 @@ func (s *Session) Data(r io.Reader) error {
 		log.Printf("Error reading mail from reader: %v", err)
 		return InvalidError
 	}
-	return mailSession.Handle(buf[:n])
+	outcome, err := s.Backend.Queue.Submit(db.QueuedMail{
+		From:     *s.From,
+		Rcpt:     s.To,
+		ClientIp: s.ClientIp,
+		Helo:     s.Helo,
+		Raw:      buf[:n],
+	})
+	if err != nil {
+		return ErrQueue
+	}
+	if outcome == nil {
+		// Queued, a worker will process it
+		return nil
+	}
+	return smtpError(*outcome)
+}
+
+// Tell the sending server why the mail was rejected. Other errors (e.g. the
+// database) and rate limited mails are retried from the queue, so the mail is
+// accepted.
+func smtpError(outcome mail.Outcome) error {
+	if !errors.Is(outcome.Err, mail.ErrInvalid) || outcome.Rejection == mail.RejectRateLimited {
+		return nil
+	}
+	message := outcome.Rejection.String()
+	if outcome.Reason != nil {
+		message = outcome.Reason.Error()
+	}
+	err := &smtp.SMTPError{Code: 550, Message: message}
+	switch outcome.Rejection {
+	case mail.RejectNoSender:
+		// Bad sender's mailbox address syntax
+		err.EnhancedCode = smtp.EnhancedCode{5, 1, 7}
+	case mail.RejectUnparsable:
+		// Media error
+		err.Code = 554
+		err.EnhancedCode = smtp.EnhancedCode{5, 6, 0}
+	case mail.RejectBadCommand:
+		// Other or undefined mail system status
+		err.EnhancedCode = smtp.EnhancedCode{5, 3, 0}
+	case mail.RejectNotVerified:
+		// Delivery not authorized, message refused
+		err.EnhancedCode = smtp.EnhancedCode{5, 7, 1}
+	default:
+		err.EnhancedCode = smtp.EnhancedCode{5, 0, 0}
+	}
+	return err
 }
 
-func (s *Session) Reset() {}
+func (s *Session) Reset() {
+	s.To = ""
+}
 
 func (s *Session) Logout() error {
 	return nil
@@ -0,0 +1,38 @@
+package smtp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/KoviRobi/tooltracker/mail"
+	"github.com/emersion/go-smtp"
+)
+
+func TestSmtpError(t *testing.T) {
+	err := smtpError(mail.Outcome{
+		Err:       mail.ErrInvalid,
+		Rejection: mail.RejectNotVerified,
+		Reason:    mail.ErrNotVerified,
+	})
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("Expected an SMTP error, got %v", err)
+	}
+	if smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+		t.Errorf("Expected 550 5.7.1, got %d %v", smtpErr.Code, smtpErr.EnhancedCode)
+	}
+
+	// Retried from the queue
+	err = smtpError(mail.Outcome{
+		Err:       mail.ErrInvalid,
+		Rejection: mail.RejectRateLimited,
+		Reason:    mail.ErrRateLimited,
+	})
+	if err != nil {
+		t.Errorf("Expected the rate limited mail to be accepted, got %v", err)
+	}
+	err = smtpError(mail.Outcome{Err: errors.New("database is locked")})
+	if err != nil {
+		t.Errorf("Expected the mail to be accepted, got %v", err)
+	}
+}
@@ -105,8 +105,8 @@ func TagsSqlFilter(tags Tags) (string, []any) {
 
 	// Make a table of tools that have matching tags
 	matchTable := `
-	SELECT tool.name FROM tool
-	LEFT JOIN tags ON tool.name = tags.tool
+	SELECT tool.id FROM tool
+	LEFT JOIN tags ON tool.id = tags.tool
 	WHERE tags.tag IN (%s)`
 
 	for tag, tagType := range tags {
@@ -0,0 +1,129 @@
+// Matching tool names as people type them, so that "Borrowed Scope 3",
+// "borrowed scope-3" and "Borrowed  scope 3 " are the same tool, and "scpoe 3"
+// can be corrected to it
+package toolname
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Shorter (canonical) names aren't fuzzy matched, e.g. "mic" and "mix" are too
+// easily confused
+const MinFuzzyLength = 5
+
+var folder = cases.Fold()
+
+// Symbols which are part of a name, e.g. "C++" and "C#" aren't "C"
+func nameSymbol(r rune) bool {
+	return unicode.IsSymbol(r) || strings.ContainsRune("#%&*@", r)
+}
+
+// Unicode NFC, case folded, with runs of whitespace and separators (other
+// punctuation, e.g. "-", "_", "." and "/") replaced by a single space, e.g.
+// "Scope-3 " gives "scope 3". Symbols (see nameSymbol) are kept inside or at
+// the end of a word.
+func Canonical(name string) string {
+	name = folder.String(norm.NFC.String(name))
+	var canonical strings.Builder
+	space := false
+	for _, r := range name {
+		inWord := !space && canonical.Len() > 0
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			if !inWord || !nameSymbol(r) {
+				space = true
+				continue
+			}
+		}
+		if space && canonical.Len() > 0 {
+			canonical.WriteByte(' ')
+		}
+		space = false
+		canonical.WriteRune(r)
+	}
+	return canonical.String()
+}
+
+// Levenshtein distance, in runes
+func Distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := range ra {
+		current[0] = i + 1
+		for j := range rb {
+			cost := 1
+			if ra[i] == rb[j] {
+				cost = 0
+			}
+			current[j+1] = min(previous[j+1]+1, current[j]+1, previous[j]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// The digits of the name, e.g. "scope 3" and "scope 4" are different tools
+// however close they are
+func digits(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// Whether a word of one name is nothing like the other's (e.g. "Probe A" and
+// "Probe B"), or one has more words, so that they are more likely different
+// tools than a typo
+func DifferentWords(a, b string) bool {
+	wordsA, wordsB := strings.Fields(Canonical(a)), strings.Fields(Canonical(b))
+	if len(wordsA) != len(wordsB) {
+		return true
+	}
+	for i := range wordsA {
+		if Distance(wordsA[i], wordsB[i]) >= max(len([]rune(wordsA[i])), len([]rune(wordsB[i]))) {
+			return true
+		}
+	}
+	return false
+}
+
+type Match struct {
+	// The existing name
+	Name     string
+	Distance int
+}
+
+// The existing names which are the same as the name (distance 0), or within
+// maxDistance of it, closest first
+func Find(name string, existing []string, maxDistance int) []Match {
+	canonical := Canonical(name)
+	fuzzy := len([]rune(canonical)) >= MinFuzzyLength
+	var matches []Match
+	for _, other := range existing {
+		otherCanonical := Canonical(other)
+		if otherCanonical == canonical {
+			matches = append(matches, Match{Name: other})
+			continue
+		}
+		if !fuzzy || digits(otherCanonical) != digits(canonical) {
+			continue
+		}
+		if distance := Distance(canonical, otherCanonical); distance <= maxDistance {
+			matches = append(matches, Match{Name: other, Distance: distance})
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b Match) int {
+		return a.Distance - b.Distance
+	})
+	return matches
+}
@@ -0,0 +1,88 @@
+package toolname
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	for _, test := range []struct{ name, expected string }{
+		{"Scope 3", "scope 3"},
+		{"scope-3", "scope 3"},
+		{"  scope   3 ", "scope 3"},
+		{"Scope_3.", "scope 3"},
+		{"PSU 30V/5A", "psu 30v 5a"},
+		// Decomposed and composed á
+		{"Ka\u0301bel", "k\u00e1bel"},
+		{"K\u00e1bel", "k\u00e1bel"},
+		{"Straße", "strasse"},
+		// Symbols are part of the name, except at the start of a word
+		{"C++", "c++"},
+		{"C#", "c#"},
+		{"C", "c"},
+		{"+5V rail", "5v rail"},
+		{"-_-", ""},
+	} {
+		if canonical := Canonical(test.name); canonical != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.name, canonical)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"scope", "", 5},
+		{"scope", "scpoe", 2},
+		{"scope", "scopes", 1},
+		{"kábel", "kabel", 1},
+	} {
+		if distance := Distance(test.a, test.b); distance != test.expected {
+			t.Errorf("Expected %d for %q, %q, got %d", test.expected, test.a, test.b, distance)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	existing := []string{"Scope 3", "Scope 4", "Soldering iron", "Mic"}
+
+	for _, test := range []struct {
+		name     string
+		expected []Match
+	}{
+		{"scope-3", []Match{{Name: "Scope 3"}}},
+		{"scpe 3", []Match{{Name: "Scope 3", Distance: 1}}},
+		// The numbers have to match
+		{"scope 5", nil},
+		{"soldering irons", []Match{{Name: "Soldering iron", Distance: 1}}},
+		{"soldring irons", []Match{{Name: "Soldering iron", Distance: 2}}},
+		// Too short
+		{"mix", nil},
+		{"MIC", []Match{{Name: "Mic"}}},
+	} {
+		matches := Find(test.name, existing, 2)
+		if !reflect.DeepEqual(matches, test.expected) {
+			t.Errorf("Expected %v for %q, got %v", test.expected, test.name, matches)
+		}
+	}
+}
+
+func TestDifferentWords(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{"Scope 3", "scpe 3", false},
+		{"Soldering iron", "soldring irons", false},
+		{"Probe A", "probe b", true},
+		{"Probe", "Probe A", true},
+		{"Red cable", "Blue cable", true},
+	} {
+		if different := DifferentWords(test.a, test.b); different != test.expected {
+			t.Errorf("Expected %t for %q, %q, got %t", test.expected, test.a, test.b, different)
+		}
+	}
+}
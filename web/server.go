@@ -2,6 +2,7 @@ package web
 
 import (
 	"bytes"
+	"crypto/subtle"
 	_ "embed"
 	"encoding/base64"
 	"errors"
@@ -13,12 +14,17 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/mnako/letters"
 	"github.com/skip2/go-qrcode"
 
 	"github.com/KoviRobi/tooltracker/artwork"
 	"github.com/KoviRobi/tooltracker/db"
 	"github.com/KoviRobi/tooltracker/limits"
+	"github.com/KoviRobi/tooltracker/mail"
+	"github.com/KoviRobi/tooltracker/ratelimit"
+	"github.com/KoviRobi/tooltracker/resolver"
 	"github.com/KoviRobi/tooltracker/tags"
 )
 
@@ -31,6 +37,18 @@ var tool_html string
 //go:embed tracker.html
 var tracker_html string
 
+//go:embed mail.html
+var mail_html string
+
+//go:embed status.html
+var status_html string
+
+//go:embed keys.html
+var keys_html string
+
+//go:embed delegations.html
+var delegations_html string
+
 type ErrorRetry struct {
 	Error error
 	Retry chan struct{}
@@ -45,10 +63,23 @@ type Server struct {
 	Domain       string
 	HttpPrefix   string
 	QrSize       int
+	// Default language of the QR code subject, see mail.SetLanguages
+	QrLanguage string
+	// Put the command in the recipient too, see mail.EncodePlusAddress
+	QrPlusAddress bool
+	// Signs the QR code subjects, see mail.QrToken. nil for no signing.
+	QrKey []byte
+	// For HTTP basic authentication (with any user name) as the admin, who can
+	// register tools and print their QR codes with tokens. Empty for no admin.
+	AdminPassword string
+	// To reprocess rejected mails, can be nil
+	Queue *mail.Queue
+	// For its stats, nil if using the system's resolver
+	Resolver *resolver.Resolver
+	// For the status page
+	Limits ratelimit.Limits
 }
 
-const maxImageSize = 100 * 1024
-
 // A simple regexp to match an URI
 var uriRe = regexp.MustCompile(
 	`([a-zA-Z][a-zA-Z0-9+.-]*):` + // Scheme
@@ -87,6 +118,57 @@ func (server *Server) getSizeMm(size string) (int, error) {
 	return int, err
 }
 
+// Whether to use a plus address in the QR code, e.g.
+// tooltracker+borrow.tool@example.com
+func (server *Server) getPlus(plus string) bool {
+	ret, err := strconv.ParseBool(plus)
+	if err != nil {
+		return server.QrPlusAddress
+	}
+	return ret
+}
+
+// Language of the QR code subject, the tool's or the deployment's default
+func (server *Server) getLanguage(tool db.Tool) string {
+	if tool.Language != nil {
+		return *tool.Language
+	}
+	return server.QrLanguage
+}
+
+// Whether the request is from the admin, see AdminPassword
+func (server *Server) isAdmin(r *http.Request) bool {
+	_, password, ok := r.BasicAuth()
+	return ok && server.AdminPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(server.AdminPassword)) == 1
+}
+
+// Whether the tool's QR code can be shown, with a token if there is a QrKey.
+// The tokens are only for registered tools, and only shown to the admin,
+// otherwise anyone could borrow a tool without its label.
+func (server *Server) showQr(r *http.Request, tool db.Tool) bool {
+	return server.QrKey == nil || (tool.Registered && server.isAdmin(r))
+}
+
+// The mailto: link to borrow a tool, by its ID so that it still works after
+// renaming. The plus address is for mail clients which mangle or drop the
+// subject. Only use it if showQr, as it has the token.
+func (server *Server) borrowLink(tool db.Tool, plus bool) string {
+	address := url.QueryEscape(server.To) + "@" + url.QueryEscape(server.Domain)
+	if plus {
+		var token string
+		if server.QrKey != nil {
+			token = mail.QrToken(server.QrKey, tool.Id)
+		}
+		address = url.PathEscape(mail.EncodePlusAddress(
+			server.To+"@"+server.Domain, "borrow", tool.Id, token))
+	}
+	return fmt.Sprintf("mailto:%s?subject=%s",
+		address,
+		url.QueryEscape(mail.Keyword("borrow", server.getLanguage(tool))+" "+mail.WithQrToken(server.QrKey, tool.Id)),
+	)
+}
+
 func (server *Server) hideEmail(email string) string {
 	split := strings.SplitN(email, "@", 2)
 	if len(split) != 2 {
@@ -119,6 +201,10 @@ type serveFormatted func(http.ResponseWriter, *http.Request) (*templateArgs, err
 func (fn serveFormatted) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var t *template.Template
 	tpl, err := fn(w, r)
+	if err == nil && tpl == nil {
+		// Already responded, e.g. redirected
+		return
+	}
 	if err == nil {
 		t, err = template.
 			New(tpl.path).
@@ -161,22 +247,24 @@ func serveStatic(contentType string, data []byte) func(http.ResponseWriter, *htt
 }
 
 func (server *Server) serveQr(w http.ResponseWriter, r *http.Request) {
-	name := r.URL.Query().Get("name")
+	tool := server.Db.GetTool(r.URL.Query().Get("id"))
 	size, err := server.getSizeMm(r.URL.Query().Get("size"))
 	// Convert mm to px
 	size = size * 8
-	link := fmt.Sprintf("mailto:%s@%s?subject=%s",
-		url.QueryEscape(server.To),
-		url.QueryEscape(server.Domain),
-		url.QueryEscape("Borrowed "+name),
-	)
+	if err == nil && tool.Id == "" {
+		err = db.ErrNoSuchTool
+	}
+	if err == nil && !server.showQr(r, tool) {
+		http.Error(w, "Only the admin can print the QR codes of registered tools", http.StatusForbidden)
+		return
+	}
 	var qr *qrcode.QRCode
 	if err == nil {
-		qr, err = qrcode.New(link, qrcode.Medium)
+		qr, err = qrcode.New(server.borrowLink(tool, server.getPlus(r.URL.Query().Get("plus"))), qrcode.Medium)
 	}
-	qr.DisableBorder = true
 	var img []byte
 	if err == nil {
+		qr.DisableBorder = true
 		img, err = qr.PNG(size)
 	}
 	if err == nil {
@@ -201,6 +289,7 @@ func (server *Server) getTracker(w http.ResponseWriter, r *http.Request) (*templ
 
 	type Item struct {
 		Tags        tags.Tags
+		Id          string
 		Tool        string
 		Description string
 		LastSeenBy  string
@@ -210,7 +299,7 @@ func (server *Server) getTracker(w http.ResponseWriter, r *http.Request) (*templ
 	var items []Item
 
 	for _, dbItem := range dbItems {
-		item := Item{Tool: dbItem.Tool}
+		item := Item{Id: dbItem.Tool, Tool: dbItem.Name}
 
 		if dbItem.Tags != nil {
 			item.Tags = tags.NormalizeTags(*dbItem.Tags)
@@ -236,10 +325,13 @@ func (server *Server) getTracker(w http.ResponseWriter, r *http.Request) (*templ
 	type Tracker struct {
 		Filter tags.Tags
 		Items  []Item
+		// Whether there are the admin only pages, see AdminPassword
+		Admin bool
 	}
 	tracker := Tracker{
 		Filter: filter,
 		Items:  items,
+		Admin:  server.AdminPassword != "",
 	}
 
 	return &templateArgs{
@@ -250,19 +342,63 @@ func (server *Server) getTracker(w http.ResponseWriter, r *http.Request) (*templ
 	}, nil
 }
 
-func (server *Server) getTool(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
-	name := r.URL.Query().Get("name")
+// Find the tool by its name (e.g. an old bookmark) and redirect to its page.
+// Only a POST (the "Create tool" form) adds it if there is no such tool, so
+// that following a link can't, registered if by the admin (see
+// db.RegisterTool).
+func (server *Server) findTool(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
+	query := r.URL.Query()
+	name := strings.TrimSpace(r.FormValue("name"))
 	if name == "" {
 		return nil, errors.New("Tool name missing")
 	}
+	id := server.Db.FindTool(name)
+	if id == "" && r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("No tool %q, use the \"Create tool\" form to add it", name), http.StatusNotFound)
+		return nil, nil
+	}
+	if id == "" {
+		err := server.Db.Transaction(func(tx db.DB) error {
+			tool, err := tx.AddTool(name)
+			if err != nil {
+				return err
+			}
+			id = tool.Id
+			if server.isAdmin(r) {
+				return tx.RegisterTool(id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error adding tool: %w", err)
+		}
+	}
+
+	// Keep e.g. the QR size
+	query.Del("name")
+	location := server.toolUrl(id)
+	if len(query) > 0 {
+		location += "?" + query.Encode()
+	}
+	http.Redirect(w, r, location, http.StatusSeeOther)
+	return nil, nil
+}
+
+func (server *Server) getTool(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
+	id := r.PathValue("id")
 	size, err := server.getSizeMm(r.URL.Query().Get("size"))
 	if err != nil {
 		return nil, fmt.Errorf("Bad size: %w", err)
 	}
 
-	dbTool := server.Db.GetTool(name)
-	if dbTool.Name == "" {
-		dbTool.Name = name
+	dbTool := server.Db.GetTool(id)
+	if dbTool.Id == "" {
+		// Merged into another tool, e.g. a bookmark of the old one
+		if into := server.Db.FindTool(id); into != "" {
+			http.Redirect(w, r, server.toolUrl(into), http.StatusSeeOther)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w %q", db.ErrNoSuchTool, id)
 	}
 	if dbTool.Description == nil {
 		empty := ""
@@ -271,7 +407,7 @@ func (server *Server) getTool(w http.ResponseWriter, r *http.Request) (*template
 
 	if r.Method == "POST" {
 		// Limit size
-		var maxMemory int64 = 101 * 1024
+		var maxMemory int64 = limits.MaxImageBytes + 1024
 		r.Body = http.MaxBytesReader(w, r.Body, maxMemory)
 
 		r.ParseMultipartForm(maxMemory)
@@ -294,6 +430,9 @@ func (server *Server) getTool(w http.ResponseWriter, r *http.Request) (*template
 			dbTool.Description = &description
 		}
 
+		language := r.FormValue("language")
+		dbTool.Language = db.NormalizeStringP(&language)
+
 		file, hdr, err := r.FormFile("image")
 		if err != nil && err != http.ErrMissingFile {
 			return nil, fmt.Errorf("Error getting attached image: %v", err)
@@ -302,7 +441,7 @@ func (server *Server) getTool(w http.ResponseWriter, r *http.Request) (*template
 		if hdr != nil {
 			defer file.Close()
 
-			imageBin := make([]byte, maxImageSize)
+			imageBin := make([]byte, limits.MaxImageBytes)
 			n, err := file.Read(imageBin)
 			imageBin = imageBin[:n]
 			dbTool.Image = base64.StdEncoding.EncodeToString(imageBin)
@@ -311,30 +450,53 @@ func (server *Server) getTool(w http.ResponseWriter, r *http.Request) (*template
 			}
 		}
 
-		server.Db.UpdateTool(dbTool)
+		err = server.Db.UpdateTool(dbTool)
+		if err != nil {
+			return nil, fmt.Errorf("Error updating tool: %w", err)
+		}
 	}
 
 	type Tool struct {
 		Tags        tags.Tags
+		Id          string
 		Name        string
 		Description string
 		Image       string
 		Link        string
+		Language    string
+		Languages   []string
 		QrSize      int
 		Hidden      bool
+		Plus        bool
+		// Whether the QR code is shown, see showQr, otherwise whether the
+		// admin can register the tool so that it is
+		ShowQr      bool
+		CanRegister bool
+		// Old names, see db.RenameTool
+		Aliases []string
+		// Whether the admin can rename it, see AdminPassword
+		Admin bool
 	}
 
-	link := fmt.Sprintf("mailto:%s@%s?subject=%s",
-		url.QueryEscape(server.To),
-		url.QueryEscape(server.Domain),
-		url.QueryEscape("Borrowed "+dbTool.Name),
-	)
+	plus := server.getPlus(r.URL.Query().Get("plus"))
 	tool := Tool{
-		Name:   dbTool.Name,
-		Link:   link,
-		Image:  dbTool.Image,
-		Tags:   dbTool.Tags,
-		QrSize: size,
+		Id:          dbTool.Id,
+		Name:        dbTool.Name,
+		Image:       dbTool.Image,
+		Tags:        dbTool.Tags,
+		QrSize:      size,
+		Plus:        plus,
+		Languages:   mail.LanguageNames(),
+		Aliases:     server.Db.GetAliasesOfTool(dbTool.Id),
+		ShowQr:      server.showQr(r, dbTool),
+		CanRegister: server.QrKey != nil && !dbTool.Registered && server.isAdmin(r),
+		Admin:       server.AdminPassword != "",
+	}
+	if tool.ShowQr {
+		tool.Link = server.borrowLink(dbTool, plus)
+	}
+	if dbTool.Language != nil {
+		tool.Language = *dbTool.Language
 	}
 	_, tool.Hidden = dbTool.Tags[tags.Hidden]
 	// Remove so that the checkbox is the canonical source
@@ -351,6 +513,247 @@ func (server *Server) getTool(w http.ResponseWriter, r *http.Request) (*template
 	}, nil
 }
 
+// Rejected (and dead) mails, for the admin to reprocess or discard
+func (server *Server) getMail(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
+	// They are anyone's mail
+	if !server.requireAdmin(w, r) {
+		return nil, nil
+	}
+	if r.Method == "POST" {
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad mail id: %w", err)
+		}
+		switch r.FormValue("action") {
+		case "Reprocess":
+			if server.Queue != nil {
+				err = server.Queue.Reprocess(id)
+			} else {
+				err = server.Db.RequeueMail(id)
+			}
+		case "Discard":
+			err = server.Db.DiscardQueued(id)
+		default:
+			err = errors.New("Unknown action")
+		}
+		if err != nil {
+			return nil, err
+		}
+		http.Redirect(w, r, server.HttpPrefix+"/mail", http.StatusSeeOther)
+		return nil, nil
+	}
+
+	type Mail struct {
+		Mail    *db.QueuedMail
+		Headers string
+		Body    string
+		Mails   []db.QueuedMail
+	}
+	var args Mail
+
+	if r.URL.Query().Has("id") {
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad mail id: %w", err)
+		}
+		args.Mail, err = server.Db.GetQueued(id)
+		if err != nil {
+			return nil, err
+		}
+		raw := strings.ReplaceAll(string(args.Mail.Raw), "\r\n", "\n")
+		args.Headers, args.Body, _ = strings.Cut(raw, "\n\n")
+		if m, err := letters.ParseEmail(bytes.NewReader(args.Mail.Raw)); err == nil {
+			args.Body = mail.ExtractBody(m)
+		}
+	} else {
+		args.Mails = server.Db.GetQueue(db.QueueQuarantined, db.QueueDead)
+	}
+
+	return &templateArgs{
+		server:  server,
+		path:    "mail.html",
+		content: mail_html,
+		args:    args,
+	}, nil
+}
+
+// OpenPGP keys of users outside the --dkim domain, see mail.Session.RequestPgpKey
+func (server *Server) getKeys(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
+	if r.Method == "POST" {
+		var err error
+		switch r.FormValue("action") {
+		case "Add":
+			// Only once the address confirms it
+			if server.Queue == nil {
+				err = mail.ErrNoSender
+			} else {
+				_, err = server.Queue.Session.RequestPgpKey(r.FormValue("email"), r.FormValue("key"), "web")
+			}
+		case "Delete":
+			// Otherwise anyone could stop someone's signed mail working
+			if !server.requireAdmin(w, r) {
+				return nil, nil
+			}
+			err = server.Db.DeletePgpKey(r.FormValue("email"))
+		default:
+			err = errors.New("Unknown action")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error updating key: %w", err)
+		}
+		http.Redirect(w, r, server.HttpPrefix+"/keys", http.StatusSeeOther)
+		return nil, nil
+	}
+
+	type Keys struct {
+		Keys []db.PgpKey
+		// Whether the admin can delete them, see AdminPassword
+		Admin bool
+	}
+
+	return &templateArgs{
+		server:  server,
+		path:    "keys.html",
+		content: keys_html,
+		args:    Keys{Keys: server.Db.GetPgpKeys(), Admin: server.AdminPassword != ""},
+	}, nil
+}
+
+// Who can send commands for whom, see the Alias command, for the admin
+func (server *Server) getDelegations(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
+	// The addresses are people's private ones
+	if !server.requireAdmin(w, r) {
+		return nil, nil
+	}
+	if r.Method == "POST" {
+		var err error
+		switch r.FormValue("action") {
+		case "Revoke":
+			_, err = server.Db.RevokeDelegation(r.FormValue("email"), nil)
+		default:
+			err = errors.New("Unknown action")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error updating delegation: %w", err)
+		}
+		http.Redirect(w, r, server.HttpPrefix+"/delegations", http.StatusSeeOther)
+		return nil, nil
+	}
+
+	type Delegation struct {
+		db.Alias
+		Status string
+	}
+	type Delegations struct {
+		Delegations []Delegation
+	}
+
+	var delegations Delegations
+	now := time.Now()
+	for _, alias := range server.Db.GetDelegations() {
+		status := "Active"
+		if alias.ConfirmToken != nil {
+			status = "Waiting for confirmation"
+		} else if !alias.Active(now) {
+			status = "Expired"
+		}
+		delegations.Delegations = append(delegations.Delegations, Delegation{alias, status})
+	}
+
+	return &templateArgs{
+		server:  server,
+		path:    "delegations.html",
+		content: delegations_html,
+		args:    delegations,
+	}, nil
+}
+
+func (server *Server) toolUrl(id string) string {
+	return server.HttpPrefix + "/tool/" + url.PathEscape(id)
+}
+
+// Rename the tool, or merge it into another one, see db.RenameTool
+func (server *Server) renameTool(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
+	if r.Method != "POST" {
+		return nil, errors.New("Expected a POST")
+	}
+	// Merging tools can't be undone
+	if !server.requireAdmin(w, r) {
+		return nil, nil
+	}
+	id, err := server.Db.RenameTool(r.FormValue("id"), r.FormValue("to"))
+	if err != nil {
+		return nil, fmt.Errorf("Error renaming tool: %w", err)
+	}
+	http.Redirect(w, r, server.toolUrl(id), http.StatusSeeOther)
+	return nil, nil
+}
+
+// Ask the browser for the admin password (see AdminPassword) unless the
+// request is from the admin. Returns whether it is.
+func (server *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if server.isAdmin(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="tooltracker admin", charset="UTF-8"`)
+	http.Error(w, "Wrong or no admin password", http.StatusUnauthorized)
+	return false
+}
+
+// Ask the browser for the admin password, see AdminPassword, then go back to
+// the page (in "next") it came from
+func (server *Server) login(w http.ResponseWriter, r *http.Request) {
+	if !server.requireAdmin(w, r) {
+		return
+	}
+	next := r.URL.Query().Get("next")
+	// Only pages of this server
+	if !strings.HasPrefix(next, server.HttpPrefix+"/") || strings.HasPrefix(next, "//") {
+		next = server.HttpPrefix + "/tracker"
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// Register a tool, so that its QR code has a token, see db.RegisterTool
+func (server *Server) registerTool(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
+	if r.Method != "POST" {
+		return nil, errors.New("Expected a POST")
+	}
+	if !server.isAdmin(r) {
+		return nil, errors.New("Only the admin can register tools")
+	}
+	id := r.FormValue("id")
+	err := server.Db.RegisterTool(id)
+	if err != nil {
+		return nil, fmt.Errorf("Error registering tool: %w", err)
+	}
+	http.Redirect(w, r, server.toolUrl(id), http.StatusSeeOther)
+	return nil, nil
+}
+
+// Health of the components, for an admin
+func (server *Server) getStatus(w http.ResponseWriter, r *http.Request) (*templateArgs, error) {
+	type Status struct {
+		Dns      *resolver.Stats
+		Servers  []string
+		Limits   ratelimit.Limits
+		Rejected ratelimit.Stats
+	}
+	status := Status{Limits: server.Limits, Rejected: server.Limits.Stats()}
+	if server.Resolver != nil {
+		stats := server.Resolver.Stats()
+		status.Dns = &stats
+		status.Servers = server.Resolver.Servers
+	}
+
+	return &templateArgs{
+		server:  server,
+		path:    "status.html",
+		content: status_html,
+		args:    status,
+	}, nil
+}
+
 func (server *Server) retry(w http.ResponseWriter, r *http.Request) {
 	errorRetry := server.LastError.Swap(nil)
 	if errorRetry != nil {
@@ -376,8 +779,19 @@ func (server *Server) Serve(listen string) error {
 	http.HandleFunc(server.HttpPrefix+"/retry", server.retry)
 	http.HandleFunc(server.HttpPrefix+"/", server.redirect)
 
-	http.Handle(server.HttpPrefix+"/tool", serveFormatted(server.getTool))
+	http.Handle(server.HttpPrefix+"/tool", serveFormatted(server.findTool))
+	http.Handle(server.HttpPrefix+"/tool/{id}", serveFormatted(server.getTool))
+	http.Handle(server.HttpPrefix+"/register", serveFormatted(server.registerTool))
+	http.HandleFunc(server.HttpPrefix+"/admin", server.login)
 	http.Handle(server.HttpPrefix+"/tracker", serveFormatted(server.getTracker))
+	// Only for the admin
+	if server.AdminPassword != "" {
+		http.Handle(server.HttpPrefix+"/mail", serveFormatted(server.getMail))
+		http.Handle(server.HttpPrefix+"/delegations", serveFormatted(server.getDelegations))
+		http.Handle(server.HttpPrefix+"/rename", serveFormatted(server.renameTool))
+	}
+	http.Handle(server.HttpPrefix+"/status", serveFormatted(server.getStatus))
+	http.Handle(server.HttpPrefix+"/keys", serveFormatted(server.getKeys))
 
 	go func() {
 		<-server.ShutdownChan